@@ -0,0 +1,160 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Backup write a copy of the latest version to w without blocking the
+// writers. the copy is a database file that can be opened by NewDB,
+// the reachable pages are renumbered so that it has no free pages.
+// the commits in the log of the WAL mode are included.
+func (db *KV) Backup(w io.Writer) error {
+	r := db.BeginRead() // the pages are not reused until it ends
+	defer r.EndRead()
+	return backupWrite(&kvBackup{tree: &r.tree, w: w}, r.tree.root)
+}
+
+// the copy of the file:
+// | master | free list | the pages of the tree |
+// | 0      | 1         | 2 ...                 |
+// the kids are written before the parent, so the root is the last page.
+type kvBackup struct {
+	tree *BTree // the snapshot
+	w    io.Writer
+	next uint64 // the page number of the copy
+	err  error
+}
+
+func backupWrite(b *kvBackup, root uint64) (err error) {
+	defer recoverPageError(&err)
+	size := b.tree.pageSize
+
+	// the master page points to the last page
+	m := &masterSlot{seq: 1, used: 2, freeList: 1, pageSize: size}
+	if root != 0 {
+		m.used += b.count(root)
+		m.root = m.used - 1
+	}
+	master := make([]byte, size)
+	copy(master[m.seq%2*MASTER_SLOT_SIZE:], masterEncode(m))
+	if _, err := b.w.Write(master); err != nil {
+		return err
+	}
+	b.next = 1
+	b.emit(NewBNode(make([]byte, size))) // an empty free list like a new file
+
+	if root != 0 {
+		b.node(root)
+	}
+	return b.err
+}
+
+// the number of the pages of the subtree
+func (b *kvBackup) count(ptr uint64) uint64 {
+	node := b.tree.get(ptr)
+	n := uint64(1)
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			n += b.count(node.getPtr(i))
+		} else if node.isOverflow(i) {
+			n += uint64(len(b.chain(node.getVal(i))))
+		}
+	}
+	return n
+}
+
+// copy the subtree and return the new pointer
+func (b *kvBackup) node(ptr uint64) uint64 {
+	node := NewBNode(bytes.Clone(b.tree.get(ptr).data))
+	for i := uint16(0); i < node.nkeys() && b.err == nil; i++ {
+		if node.btype() == BNODE_NODE {
+			node.setPtr(i, b.node(node.getPtr(i)))
+		} else if node.isOverflow(i) {
+			stub := node.getVal(i)
+			binary.LittleEndian.PutUint64(stub[8:], b.overflow(stub))
+		}
+	}
+	return b.emit(node)
+}
+
+// the pages of an overflow chain
+func (b *kvBackup) chain(stub []byte) []uint64 {
+	var ptrs []uint64
+	for ptr := binary.LittleEndian.Uint64(stub[8:]); ptr != 0; {
+		ptrs = append(ptrs, ptr)
+		ptr = binary.LittleEndian.Uint64(overflowGet(b.tree, ptr).data[4:])
+	}
+	return ptrs
+}
+
+// copy an overflow chain from the tail and return the new head
+func (b *kvBackup) overflow(stub []byte) uint64 {
+	ptrs := b.chain(stub)
+	next := uint64(0)
+	for i := len(ptrs) - 1; i >= 0 && b.err == nil; i-- {
+		node := NewBNode(bytes.Clone(b.tree.get(ptrs[i]).data))
+		binary.LittleEndian.PutUint64(node.data[4:], next)
+		next = b.emit(node)
+	}
+	return next
+}
+
+// write the next page of the copy
+func (b *kvBackup) emit(node BNode) uint64 {
+	ptr := b.next
+	b.next++
+	if b.err == nil {
+		pageChecksum(node)
+		_, b.err = b.w.Write(node.data)
+	}
+	return ptr
+}
+
+// BackupTo write a copy of the database to the file, see KV.Backup.
+// the file must not be the database itself, its log or its lock file.
+func (db *DB) BackupTo(path string) error {
+	if db.kv.isOpenFile(path) || db.kv.isOpenFile(walPath(path)) {
+		return fmt.Errorf("tinydb: backup to %s: the file is in use by the database", path)
+	}
+	// the log of an old file would be replayed on the copy
+	if err := os.Remove(walPath(path)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove log: %w", err)
+	}
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, db.kv.FileMode)
+	if err != nil {
+		return fmt.Errorf("create backup: %w", err)
+	}
+	err = db.kv.Backup(fp)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("backup to %s: %w", path, err)
+	}
+	return nil
+}
+
+// whether the path is the database file, the log or the lock file opened by the KV
+func (db *KV) isOpenFile(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	for _, fp := range []*os.File{db.fp, db.wal.fp, db.lock.fp} {
+		if fp == nil {
+			continue
+		}
+		if open, err := fp.Stat(); err == nil && os.SameFile(info, open) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package tinydb
+
+import (
+	"bytes"
+	"errors"
+)
+
+// WriteBatch a list of updates applied by KV.WriteBatch in a single commit
+type WriteBatch struct {
+	entries []batchEntry
+}
+
+type batchEntry struct {
+	key  []byte
+	val  []byte
+	del  bool
+	mode UpdateMode
+}
+
+// BatchResult the result of an entry in the batch
+type BatchResult struct {
+	OK  bool  // the key is updated or deleted
+	Err error // the entry is rejected by its UpdateMode
+}
+
+// Put add or replace a key
+func (b *WriteBatch) Put(key, val []byte) {
+	b.PutMode(key, val, MODE_UPSERT)
+}
+
+// PutMode update a key with the mode, see Update
+func (b *WriteBatch) PutMode(key, val []byte, mode UpdateMode) {
+	b.entries = append(b.entries, batchEntry{key: bytes.Clone(key), val: bytes.Clone(val), mode: mode})
+}
+
+// Delete remove a key
+func (b *WriteBatch) Delete(key []byte) {
+	b.entries = append(b.entries, batchEntry{key: bytes.Clone(key), del: true})
+}
+
+// Len the number of entries
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Reset remove all entries so that the batch can be reused
+func (b *WriteBatch) Reset() {
+	b.entries = b.entries[:0]
+}
+
+// WriteBatch apply the entries in order and flush them once.
+// the entries rejected by their modes are skipped and reported
+// in the results, the others are applied.
+func (db *KV) WriteBatch(batch *WriteBatch) ([]BatchResult, error) {
+	for {
+		tx := db.Begin()
+		results, err := batchApply(tx, batch)
+		if err != nil {
+			tx.Abort()
+			return nil, err
+		}
+		err = tx.Commit()
+		if err == nil {
+			return results, nil
+		}
+		if !errors.Is(err, ErrConflict) {
+			return nil, err
+		}
+	}
+}
+
+func batchApply(tx *KVTX, batch *WriteBatch) ([]BatchResult, error) {
+	results := make([]BatchResult, len(batch.entries))
+	for i, e := range batch.entries {
+		if e.del {
+			deleted, err := tx.Delete(e.key)
+			if err != nil {
+				return nil, err
+			}
+			results[i].OK = deleted
+			continue
+		}
+		if e.mode != MODE_UPSERT {
+			_, exists, err := tx.Get(e.key)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkUpdateMode(e.key, exists, e.mode); err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		if err := tx.Set(e.key, e.val); err != nil {
+			return nil, err
+		}
+		results[i].OK = true
+	}
+	return results, nil
+}
@@ -0,0 +1,385 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// FLAG_BLOB the pending update is a stub of the pages written by BlobWriter
+const FLAG_BLOB = byte(3)
+
+// BlobReader reads a value as a stream.
+// the overflow pages are read one by one instead of loading the whole value.
+type BlobReader struct {
+	tree   *BTree
+	close  func() // end the snapshot if it's owned by the reader
+	inline []byte // the value is not in overflow pages
+	total  int64
+	head   uint64
+	off    int64 // the read position
+	// the page containing the read position, 0 if unknown
+	ptr   uint64
+	begin int64 // the offset of the page
+}
+
+// OpenBlob read a value as a stream, the reader must be closed.
+func (db *KV) OpenBlob(key []byte) (*BlobReader, error) {
+	r := db.BeginRead()
+	b, err := r.OpenBlob(key)
+	if err != nil {
+		r.EndRead()
+		return nil, err
+	}
+	b.close = r.EndRead
+	return b, nil
+}
+
+// OpenBlob read a value as a stream, it's valid until the reader is done.
+func (r *KVReader) OpenBlob(key []byte) (b *BlobReader, err error) {
+	if err := checkKey(key, r.tree.pageSize); err != nil {
+		return nil, err
+	}
+	if r.tree.root == 0 {
+		return nil, ErrNotFound
+	}
+
+	defer recoverPageError(&err)
+	leaf, idx, ok := treeLookup(&r.tree, r.tree.get(r.tree.root), key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	b = &BlobReader{tree: &r.tree}
+	val := leaf.getVal(idx)
+	if leaf.isOverflow(idx) {
+		b.total = int64(binary.LittleEndian.Uint64(val[0:]))
+		b.head = binary.LittleEndian.Uint64(val[8:])
+	} else {
+		b.inline = bytes.Clone(val)
+		b.total = int64(len(val))
+	}
+	return b, nil
+}
+
+// Size the size of the value
+func (b *BlobReader) Size() int64 {
+	return b.total
+}
+
+// Read implements io.Reader, it reads at most 1 page at a time
+func (b *BlobReader) Read(p []byte) (n int, err error) {
+	if b.off >= b.total {
+		return 0, io.EOF
+	}
+	if b.inline != nil {
+		n = copy(p, b.inline[b.off:])
+		b.off += int64(n)
+		return n, nil
+	}
+
+	defer recoverPageError(&err)
+	node := b.locate()
+	data := node.data[OVERFLOW_HEADER:][:overflowSize(node)]
+	n = copy(p, data[b.off-b.begin:])
+	b.off += int64(n)
+	return n, nil
+}
+
+// find the page containing the read position
+func (b *BlobReader) locate() BNode {
+	if b.ptr == 0 || b.off < b.begin {
+		b.ptr, b.begin = b.head, 0 // the chain is singly linked
+	}
+	for {
+		if b.ptr == 0 {
+			panic(ErrCorrupted) // shorter than the size
+		}
+		node := overflowGet(b.tree, b.ptr)
+		size := int64(overflowSize(node))
+		if b.off < b.begin+size {
+			return node
+		}
+		b.ptr = binary.LittleEndian.Uint64(node.data[4:])
+		b.begin += size
+	}
+}
+
+// Seek implements io.Seeker
+func (b *BlobReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.total
+	default:
+		return 0, fmt.Errorf("tinydb: bad whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("tinydb: negative position")
+	}
+	b.off = offset
+	return offset, nil
+}
+
+// Close end the snapshot opened by KV.OpenBlob, it's a no-op otherwise.
+func (b *BlobReader) Close() error {
+	if b.close != nil {
+		b.close()
+		b.close = nil
+	}
+	return nil
+}
+
+// BlobWriter writes a value as a stream.
+// the data is written to the pages reserved at the end of the file
+// without being buffered in memory, the key is updated when it's closed.
+// the reserved pages are leaked if the process crashes before that,
+// they are reclaimed when the file is opened again.
+type BlobWriter struct {
+	db    *KV
+	key   []byte
+	total uint64
+	pages []uint64 // the reserved pages
+	page  BNode    // the last page being filled
+	done  bool
+}
+
+// CreateBlob write a value as a stream, the writer must be closed or aborted.
+func (db *KV) CreateBlob(key []byte) (*BlobWriter, error) {
+	if db.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if err := checkKey(key, db.PageSize); err != nil {
+		return nil, err
+	}
+	return &BlobWriter{db: db, key: bytes.Clone(key)}, nil
+}
+
+// Write implements io.Writer
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	assert(!w.done, "the blob writer is done!")
+	n := 0
+	for len(p) > 0 {
+		if len(w.pages) == 0 || overflowSize(w.page) == overflowCap(w.db.PageSize) {
+			if err := w.nextPage(); err != nil {
+				return n, err
+			}
+		}
+		size := overflowSize(w.page)
+		copied := copy(w.page.data[OVERFLOW_HEADER+size:nodeSize(w.db.PageSize)], p)
+		binary.LittleEndian.PutUint16(w.page.data[2:], uint16(size+copied))
+		p = p[copied:]
+		n += copied
+	}
+	w.total += uint64(n)
+	return n, nil
+}
+
+// link a new page to the chain and write the full page
+func (w *BlobWriter) nextPage() error {
+	ptr, err := blobReserve(w.db)
+	if err != nil {
+		return err
+	}
+	if len(w.pages) > 0 {
+		binary.LittleEndian.PutUint64(w.page.data[4:], ptr)
+		if err := pageWrite(w.db, w.pages[len(w.pages)-1], w.page); err != nil {
+			return err
+		}
+	}
+	w.pages = append(w.pages, ptr)
+	w.page = NewBNode(make([]byte, w.db.PageSize))
+	binary.LittleEndian.PutUint16(w.page.data[0:], BNODE_OVERFLOW)
+	return nil
+}
+
+// Close write the last page and update the key
+func (w *BlobWriter) Close() error {
+	assert(!w.done, "the blob writer is done!")
+	head := uint64(0)
+	if len(w.pages) > 0 {
+		head = w.pages[0]
+		if err := pageWrite(w.db, w.pages[len(w.pages)-1], w.page); err != nil {
+			w.Abort()
+			return err
+		}
+	}
+	stub := make([]byte, 1+OVERFLOW_STUB)
+	stub[0] = FLAG_BLOB
+	binary.LittleEndian.PutUint64(stub[1:], w.total)
+	binary.LittleEndian.PutUint64(stub[9:], head)
+
+	// a blind write never conflicts
+	tx := w.db.Begin()
+	if err := tx.pending.insert(w.key, stub); err != nil {
+		tx.Abort()
+		w.Abort()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		w.Abort()
+		return err
+	}
+	w.done = true
+	blobRelease(w.db, len(w.pages))
+	return nil
+}
+
+// Abort discard the data and return the reserved pages to the free list
+func (w *BlobWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	if len(w.pages) == 0 {
+		return
+	}
+
+	db := w.db
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	saved := saveState(db)
+	for _, ptr := range w.pages {
+		db.pageDel(ptr)
+	}
+	if err := flushPages(db); err != nil {
+		restoreState(db, saved)
+		db.Logger.Printf("tinydb: %d blob pages are leaked: %v", len(w.pages), err)
+		return
+	}
+	db.page.reserved -= len(w.pages)
+}
+
+// reserve a page at the end of the file for BlobWriter.
+// it's not visible until it's linked to the tree.
+func blobReserve(db *KV) (uint64, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	ptr, err := pageReserve(db)
+	if err == nil {
+		db.page.reserved++
+	}
+	return ptr, err
+}
+
+// the reserved pages are linked to the tree, see masterClose
+func blobRelease(db *KV, n int) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	db.page.reserved -= n
+}
+
+// OpenBlob read a value as a stream, it's valid within the transaction.
+func (tx *KVTX) OpenBlob(key []byte) (*BlobReader, error) {
+	if val, ok, _ := tx.pending.Get(key); ok {
+		// updated by this transaction
+		if val[0] != FLAG_UPDATED {
+			return nil, ErrNotFound
+		}
+		return &BlobReader{inline: val[1:], total: int64(len(val) - 1)}, nil
+	}
+	key = bytes.Clone(key) // the caller can reuse the buffer
+	tx.reads = append(tx.reads, &keyRange{start: key, stop: key})
+	return tx.snapshot.OpenBlob(key)
+}
+
+// the blob columns are stored under their own keys:
+// | BLOB_PREFIX | table prefix | column | primary key |
+// | 4B          | 4B           | 2B     | ...         |
+// the row stores the key as the reference.
+func blobKey(tdef *TableDef, pkeys []Value, col int) []byte {
+	key := binary.BigEndian.AppendUint32(nil, BLOB_PREFIX)
+	key = binary.BigEndian.AppendUint32(key, tdef.Prefix)
+	key = binary.BigEndian.AppendUint16(key, uint16(col))
+	return encodeValues(key, pkeys)
+}
+
+// store the blobs of a row and replace them with the references
+func blobUpdate(tx *DBTX, tdef *TableDef, values []Value) error {
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		if tdef.Types[i] != TYPE_BLOB {
+			continue
+		}
+		key := blobKey(tdef, values[:tdef.PKeys], i)
+		if values[i].Str != nil { // nil keeps the existing blob
+			if err := tx.kv.Set(key, values[i].Str); err != nil {
+				return err
+			}
+		}
+		values[i].Str = key
+	}
+	return nil
+}
+
+// remove the blobs of a row
+func blobDelete(tx *DBTX, tdef *TableDef, values []Value) error {
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		if tdef.Types[i] == TYPE_BLOB {
+			if _, err := tx.kv.Delete(blobKey(tdef, values[:tdef.PKeys], i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// find the blob column by the primary key and the column name
+func blobColumn(tdef *TableDef, rec Record, col string) ([]byte, error) {
+	values, err := checkRecord(tdef, rec, tdef.PKeys)
+	if err != nil {
+		return nil, err
+	}
+	idx := slices.Index(tdef.Cols, col)
+	if idx < 0 || tdef.Types[idx] != TYPE_BLOB {
+		return nil, fmt.Errorf("tinydb: not a blob column: %s", col)
+	}
+	return blobKey(tdef, values[:tdef.PKeys], idx), nil
+}
+
+// OpenBlob read a blob column of the row by the primary key.
+// the reader must be closed.
+func (db *DB) OpenBlob(table string, rec Record, col string) (*BlobReader, error) {
+	tx := db.Begin()
+	b, err := tx.OpenBlob(table, rec, col)
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	b.close = tx.Abort
+	return b, nil
+}
+
+// OpenBlob read a blob column of the row by the primary key.
+// the reader is valid within the transaction.
+func (tx *DBTX) OpenBlob(table string, rec Record, col string) (*BlobReader, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	key, err := blobColumn(tdef, rec, col)
+	if err != nil {
+		return nil, err
+	}
+	return tx.kv.OpenBlob(key)
+}
+
+// CreateBlob write a blob column of the row as a stream, the writer
+// must be closed or aborted. the row can be added before or after the
+// blob is written, with a nil blob to keep it.
+func (db *DB) CreateBlob(table string, rec Record, col string) (*BlobWriter, error) {
+	tx := db.Begin()
+	tdef, err := getTableDef(tx, table)
+	tx.Abort()
+	if err != nil {
+		return nil, err
+	}
+	key, err := blobColumn(tdef, rec, col)
+	if err != nil {
+		return nil, err
+	}
+	return db.kv.CreateBlob(key)
+}
@@ -6,9 +6,11 @@ import (
 )
 
 const (
-	HEADER     = 4 // type(2B) + size(2B)
+	HEADER     = 4 // type(2B) + size(2B), followed by the key prefix
 	BNODE_NODE = 1 // internal nodes without values
 	BNODE_LEAF = 2 // leaf nodes with values
+	// the high bit of vlen, the value is a stub of overflow pages
+	BNODE_VAL_OVERFLOW = uint16(1) << 15
 )
 
 type BNode struct {
@@ -33,14 +35,33 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node.data[2:4], nkeys)
 }
 
+// the prefix shared by all keys in a leaf, it's stored only once.
+// it's set right after the header, before adding any keys.
+// | plen | prefix |
+// | 2B   | ...    |
+func (node BNode) getPrefix() []byte {
+	plen := binary.LittleEndian.Uint16(node.data[HEADER:])
+	return node.data[HEADER+2:][:plen]
+}
+
+func (node BNode) setPrefix(prefix []byte) {
+	binary.LittleEndian.PutUint16(node.data[HEADER:], uint16(len(prefix)))
+	copy(node.data[HEADER+2:], prefix)
+}
+
+// the size of the header and the prefix
+func (node BNode) headerSize() uint16 {
+	return HEADER + 2 + binary.LittleEndian.Uint16(node.data[HEADER:])
+}
+
 // pointers
 func (node BNode) getPtr(idx uint16) uint64 {
-	pos := HEADER + 8*idx
+	pos := node.headerSize() + 8*idx
 	return binary.LittleEndian.Uint64(node.data[pos:])
 }
 
 func (node BNode) setPtr(idx uint16, data uint64) {
-	pos := HEADER + 8*idx
+	pos := node.headerSize() + 8*idx
 	binary.LittleEndian.PutUint64(node.data[pos:], data)
 }
 
@@ -57,27 +78,55 @@ func (node BNode) setOffset(idx uint16, offset uint16) {
 }
 
 func offsetPos(node BNode, idx uint16) uint16 {
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.headerSize() + 8*node.nkeys() + 2*(idx-1)
 }
 
 // key-values
 func (node BNode) kvPos(idx uint16) uint16 {
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	return node.headerSize() + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
 }
 
-func (node BNode) getKey(idx uint16) []byte {
+// the key without the prefix
+func (node BNode) getSuffix(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.data[pos:])
 	return node.data[pos+4:][:klen]
 }
 
+// the full key, it's a copy unless the prefix is empty
+func (node BNode) getKey(idx uint16) []byte {
+	prefix := node.getPrefix()
+	if len(prefix) == 0 {
+		return node.getSuffix(idx)
+	}
+	return append(bytes.Clone(prefix), node.getSuffix(idx)...)
+}
+
+// whether the key at idx is equal to the key, without copying it
+func (node BNode) keyEqual(idx uint16, key []byte) bool {
+	prefix := node.getPrefix()
+	return bytes.HasPrefix(key, prefix) && bytes.Equal(node.getSuffix(idx), key[len(prefix):])
+}
+
 func (node BNode) getVal(idx uint16) []byte {
 	pos := node.kvPos(idx)
 	klen := binary.LittleEndian.Uint16(node.data[pos+0:])
-	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	vlen := binary.LittleEndian.Uint16(node.data[pos+2:]) &^ BNODE_VAL_OVERFLOW
 	return node.data[pos+4+klen:][:vlen]
 }
 
+// whether the value is stored in overflow pages
+func (node BNode) isOverflow(idx uint16) bool {
+	pos := node.kvPos(idx)
+	return binary.LittleEndian.Uint16(node.data[pos+2:])&BNODE_VAL_OVERFLOW != 0
+}
+
+func (node BNode) setOverflow(idx uint16) {
+	pos := node.kvPos(idx)
+	vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+	binary.LittleEndian.PutUint16(node.data[pos+2:], vlen|BNODE_VAL_OVERFLOW)
+}
+
 // node size in bytes
 func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
@@ -86,32 +135,62 @@ func (node BNode) nbytes() uint16 {
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
 func nodeLookupLE(node BNode, key []byte) uint16 {
 	nkeys := node.nkeys()
-	found := uint16(0)
+	prefix := node.getPrefix()
+	if !bytes.HasPrefix(key, prefix) {
+		// the key is before or after all keys, they have the prefix
+		if bytes.Compare(key, prefix) < 0 {
+			return 0
+		}
+		return nkeys - 1
+	}
+	suffix := key[len(prefix):]
+	// binary search for the first key that is greater than the key.
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key.
-	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
-		if cmp <= 0 {
-			found = i
-		}
-		if cmp >= 0 {
-			break
+	lo, hi := uint16(1), nkeys
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if bytes.Compare(node.getSuffix(mid), suffix) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
 		}
 	}
-	return found
+	return lo - 1
 }
 
 // add a new key to leaf node
 func leafInsert(new, old BNode, idx uint16, key, value []byte) {
 	new.setHeader(BNODE_LEAF, old.nkeys()+1)
+	// the prefix is shortened if the key doesn't have it, see leafFits
+	new.setPrefix(commonPrefix(old.getPrefix(), key))
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, value)
 	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
 }
 
+// the keys of a leaf are expanded if its prefix is shortened by the new
+// key, this is false if the expanded keys no longer fit in a page.
+// a key without the prefix is after all the keys (the first key is a copy
+// from the parent), so it can be put in a new leaf instead, see leafSingle.
+func leafFits(node BNode, key []byte, pageSize int) bool {
+	prefix := node.getPrefix()
+	shorter := len(prefix) - len(commonPrefix(prefix, key))
+	return int(node.nbytes())+int(node.nkeys())*shorter <= nodeSize(pageSize)
+}
+
+// a new leaf with only the key after the old leaf. the prefix is
+// shortened like leafInsert, so that the next keys can be added to it.
+func leafSingle(new, old BNode, key, value []byte) {
+	new.setHeader(BNODE_LEAF, 1)
+	new.setPrefix(commonPrefix(old.getPrefix(), key))
+	nodeAppendKV(new, 0, 0, key, value)
+}
+
 // update kv to leaf node
 func leafUpdate(new, old BNode, idx uint16, key, value []byte) {
 	new.setHeader(BNODE_LEAF, old.nkeys())
+	new.setPrefix(old.getPrefix())
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, value)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-idx-1)
@@ -120,6 +199,7 @@ func leafUpdate(new, old BNode, idx uint16, key, value []byte) {
 // remove a key from a leaf node
 func leafDelete(new, old BNode, idx uint16) {
 	new.setHeader(BNODE_LEAF, old.nkeys()-1)
+	new.setPrefix(old.getPrefix())
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-idx-1)
 }
@@ -129,6 +209,17 @@ func nodeAppendRange(new, old BNode, dstNew, srcOld uint16, n uint16) {
 	if n == 0 {
 		return
 	}
+	if !bytes.Equal(new.getPrefix(), old.getPrefix()) {
+		// the keys are re-encoded with the new prefix
+		for i := uint16(0); i < n; i++ {
+			src := srcOld + i
+			nodeAppendKV(new, dstNew+i, old.getPtr(src), old.getKey(src), old.getVal(src))
+			if old.isOverflow(src) {
+				new.setOverflow(dstNew + i)
+			}
+		}
+		return
+	}
 
 	// pointers
 	for i := uint16(0); i < n; i++ {
@@ -147,8 +238,11 @@ func nodeAppendRange(new, old BNode, dstNew, srcOld uint16, n uint16) {
 	copy(new.data[new.kvPos(dstNew):], old.data[begin:end])
 }
 
-// copy a KV into the position
+// copy a KV into the position, the key must have the prefix of the node
 func nodeAppendKV(new BNode, idx uint16, ptr uint64, key, value []byte) {
+	prefix := new.getPrefix()
+	assert(bytes.HasPrefix(key, prefix), "the key is out of the node!")
+	key = key[len(prefix):]
 	// ptrs
 	new.setPtr(idx, ptr)
 	// KVs
@@ -162,39 +256,46 @@ func nodeAppendKV(new BNode, idx uint16, ptr uint64, key, value []byte) {
 }
 
 // split a node if it's too big, the result are 1-3 nodes
-func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
-		old.data = old.data[:BTREE_PAGE_SIZE]
+func nodeSplit3(old BNode, pageSize int) (uint16, [3]BNode) {
+	if int(old.nbytes()) <= nodeSize(pageSize) {
+		old.data = old.data[:pageSize]
 		return 1, [3]BNode{old}
 	}
 
-	left := NewBNode(make([]byte, BTREE_PAGE_SIZE<<1)) // might be split later
-	right := NewBNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
-		left.data = left.data[:BTREE_PAGE_SIZE]
+	left := NewBNode(make([]byte, pageSize<<1)) // might be split later
+	right := NewBNode(make([]byte, pageSize))
+	nodeSplit2(left, right, old, pageSize)
+	if int(left.nbytes()) <= nodeSize(pageSize) {
+		left.data = left.data[:pageSize]
 		return 2, [3]BNode{left, right}
 	}
 	// the left node is still too large
-	leftleft := NewBNode(make([]byte, BTREE_PAGE_SIZE))
-	middle := NewBNode(make([]byte, BTREE_PAGE_SIZE))
-	nodeSplit2(leftleft, middle, left)
+	leftleft := NewBNode(make([]byte, pageSize))
+	middle := NewBNode(make([]byte, pageSize))
+	nodeSplit2(leftleft, middle, left, pageSize)
 
 	return 3, [3]BNode{leftleft, middle, right}
 }
 
-func nodeSplit2(left, right, old BNode) {
+func nodeSplit2(left, right, old BNode, pageSize int) {
 	nkeys := old.nkeys()
-	nbytes := old.nbytes()
-
-	rightCount := uint16(1)
-	for ; rightCount <= nkeys; rightCount++ {
-		rightBytes := HEADER + 8*rightCount + 2*rightCount + (nbytes - old.getOffset(nkeys-rightCount))
-		if rightBytes == BTREE_PAGE_SIZE {
+	end := old.getOffset(nkeys)
+	limit := nodeSize(pageSize)
+
+	// the size is estimated with the old prefix,
+	// the prefixes of the new nodes are not shorter.
+	// the right node takes about half of the bytes, a full right node
+	// would leave a single key on the left for sequential insertions.
+	half := int(old.nbytes()) / 2
+	rightCount := uint16(0)
+	for rightCount < nkeys-1 {
+		next := rightCount + 1
+		rightBytes := int(old.headerSize() + 8*next + 2*next + (end - old.getOffset(nkeys-next)))
+		if rightBytes > limit {
 			break
 		}
-		if rightBytes > BTREE_PAGE_SIZE {
-			rightCount -= 1
+		rightCount = next
+		if rightBytes >= half {
 			break
 		}
 	}
@@ -202,15 +303,60 @@ func nodeSplit2(left, right, old BNode) {
 	idx := nkeys - rightCount
 
 	left.setHeader(old.btype(), idx)
+	left.setPrefix(leafPrefix(old.btype(), old.getKey(0), old.getKey(idx-1)))
 	nodeAppendRange(left, old, 0, 0, idx)
 
 	right.setHeader(old.btype(), nkeys-idx)
+	right.setPrefix(leafPrefix(old.btype(), old.getKey(idx), old.getKey(nkeys-1)))
 	nodeAppendRange(right, old, 0, idx, nkeys-idx)
 }
 
+// the common prefix of the sorted keys [first, last] in a leaf.
+// internal nodes don't use prefixes, their keys can be replaced by
+// deletions, and a key without the prefix would grow the node.
+func leafPrefix(btype uint16, first, last []byte) []byte {
+	if btype != BNODE_LEAF {
+		return nil
+	}
+	return commonPrefix(first, last)
+}
+
+func commonPrefix(a, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
+// the prefix of the node merged from 2 nodes
+func mergePrefix(left, right BNode) []byte {
+	if left.nkeys() == 0 {
+		return leafPrefix(right.btype(), right.getKey(0), right.getKey(right.nkeys()-1))
+	}
+	if right.nkeys() == 0 {
+		return leafPrefix(left.btype(), left.getKey(0), left.getKey(left.nkeys()-1))
+	}
+	return leafPrefix(left.btype(), left.getKey(0), right.getKey(right.nkeys()-1))
+}
+
+// the size of the node merged from 2 nodes
+func nodeMergeSize(left, right BNode) int {
+	plen := len(mergePrefix(left, right))
+	size := HEADER + 2 + plen
+	for _, node := range []BNode{left, right} {
+		// the keys are re-encoded with the new prefix
+		n := int(node.nkeys())
+		size += 8*n + 2*n + int(node.getOffset(node.nkeys()))
+		size += n * (len(node.getPrefix()) - plen)
+	}
+	return size
+}
+
 // merge 2 node into 1
 func nodeMerge(new, left, right BNode) {
-	new.setHeader(left.btype(), left.nkeys()+right.btype())
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	new.setPrefix(mergePrefix(left, right))
 	nodeAppendRange(new, left, 0, 0, left.nkeys())
 	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
 }
@@ -2,66 +2,112 @@ package tinydb
 
 import (
 	"bytes"
+	"fmt"
 )
 
 const (
-	BTREE_PAGE_SIZE           = 4096 // page size is defined to 4K
+	BTREE_PAGE_SIZE     = 4096     // the default page size
+	BTREE_PAGE_SIZE_MIN = 1024     // the master page has 2 slots of 512B
+	BTREE_PAGE_SIZE_MAX = 32 << 10 // the offsets in a node are 16 bits
+	BTREE_PAGE_CHECKSUM = 4        // crc32 at the end of each page
+	// the limits of the default page size, see maxKeySize & maxInlineSize
 	BTREE_PAGE_MAX_KEY_SIZE   = 1000
-	BTREE_PAGE_MAX_VALUE_SIZE = 3000
+	BTREE_PAGE_MAX_VALUE_SIZE = 3000    // larger values are stored in overflow pages
+	BTREE_MAX_VALUE_SIZE      = 1 << 30 // 1GB
 )
 
 type BTree struct {
 	// pointer (a nonzero page number)
 	root uint64
-	// callbacks for managing on-disk pages
+	// the page size of the file, see checkPageSize
+	pageSize int
+	// callbacks for managing on-disk pages.
+	// they panic on bad pages, see recoverPageError. the tree is
+	// left in a partial state by such errors and must be rolled back.
 	get func(uint64) BNode // deference a pointer
 	new func(BNode) uint64 // allocate a new page
 	del func(uint64)       // deallocate a page
 }
 
-func (tree *BTree) Get(key []byte) ([]byte, bool) {
-	assert(len(key) > 0 && len(key) <= BTREE_PAGE_MAX_KEY_SIZE, "bad key!")
-
+func (tree *BTree) Get(key []byte) (val []byte, ok bool, err error) {
+	if err := checkKey(key, tree.pageSize); err != nil {
+		return nil, false, err
+	}
 	if tree.root == 0 {
-		return nil, false
+		return nil, false, nil
 	}
 
-	node := tree.get(tree.root)
-	return treeGet(tree, node, key)
+	defer recoverPageError(&err)
+	leaf, idx, ok := treeLookup(tree, tree.get(tree.root), key)
+	if !ok {
+		return nil, false, nil
+	}
+	val = leaf.getVal(idx)
+	if leaf.isOverflow(idx) {
+		val = overflowRead(tree, val)
+	}
+	return val, true, nil
 }
 
-func (tree *BTree) Delete(key []byte) bool {
-	assert(len(key) > 0 && len(key) <= BTREE_PAGE_MAX_KEY_SIZE, "bad key!")
-
+func (tree *BTree) Delete(key []byte) (ok bool, err error) {
+	if err := checkKey(key, tree.pageSize); err != nil {
+		return false, err
+	}
 	if tree.root == 0 {
-		return false
+		return false, nil
 	}
 
+	defer recoverPageError(&err)
 	updated := treeDelete(tree, tree.get(tree.root), key)
 	if len(updated.data) == 0 {
-		return false // not found
+		return false, nil // not found
 	}
 
 	tree.del(tree.root)
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// remove a level
 		tree.root = updated.getPtr(0)
-	} else {
-		tree.root = tree.new(updated)
+		return true, nil
 	}
+	nsplit, splitted := nodeSplit3(updated, tree.pageSize)
+	tree.root = tree.newRoot(splitted[:nsplit])
+	return true, nil
+}
 
-	return true
+func (tree *BTree) Insert(key, value []byte) error {
+	if err := checkKey(key, tree.pageSize); err != nil {
+		return err
+	}
+	if len(value) > BTREE_MAX_VALUE_SIZE {
+		return ErrValueTooLarge
+	}
+	return tree.insert(key, value)
 }
 
-func (tree *BTree) Insert(key, value []byte) {
-	assert(len(key) > 0 && len(key) <= BTREE_PAGE_MAX_KEY_SIZE, "bad key!")
-	assert(len(value) <= BTREE_PAGE_MAX_VALUE_SIZE, "bad value!")
+// insert without checking the sizes
+func (tree *BTree) insert(key, value []byte) (err error) {
+	defer recoverPageError(&err)
+	overflow := len(value) > maxInlineSize(tree.pageSize)
+	if overflow {
+		value = overflowWrite(tree, value)
+	}
+	tree.insertKV(key, value, overflow)
+	return nil
+}
 
+// insert a value or a stub of overflow pages
+func (tree *BTree) insertKV(key, value []byte, overflow bool) {
 	if tree.root == 0 {
 		// create the first node
-		root := NewBNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_LEAF, 1)
-		nodeAppendKV(root, 0, 0, key, value)
+		root := NewBNode(make([]byte, tree.pageSize))
+		root.setHeader(BNODE_LEAF, 2)
+		// a dummy key, this makes the tree cover the whole key space.
+		// thus a lookup can always find a containing node.
+		nodeAppendKV(root, 0, 0, nil, nil)
+		nodeAppendKV(root, 1, 0, key, value)
+		if overflow {
+			root.setOverflow(1)
+		}
 		tree.root = tree.new(root)
 		return
 	}
@@ -69,93 +115,152 @@ func (tree *BTree) Insert(key, value []byte) {
 	node := tree.get(tree.root)
 	tree.del(tree.root)
 
-	node = treeInsert(tree, node, key, value)
-	nsplit, splitted := nodeSplit3(node)
-	if nsplit > 1 {
-		// the root was split, add a new level
-		root := NewBNode(make([]byte, BTREE_PAGE_SIZE))
-		root.setHeader(BNODE_NODE, nsplit)
-		for i, knode := range splitted {
-			ptr, kk := tree.new(knode), knode.getKey(0)
-			nodeAppendKV(root, uint16(i), ptr, kk, nil)
-		}
-		tree.root = tree.new(root)
-	} else {
-		tree.root = tree.new(splitted[0])
+	splitted := treeInsert(tree, node, key, value, overflow)
+	tree.root = tree.newRoot(splitted)
+}
+
+// allocate the root from the nodes split from it
+func (tree *BTree) newRoot(splitted []BNode) uint64 {
+	if len(splitted) == 1 {
+		return tree.new(splitted[0])
 	}
+	// the root was split, add a new level
+	root := NewBNode(make([]byte, tree.pageSize))
+	root.setHeader(BNODE_NODE, uint16(len(splitted)))
+	for i, knode := range splitted {
+		ptr, kk := tree.new(knode), knode.getKey(0)
+		nodeAppendKV(root, uint16(i), ptr, kk, nil)
+	}
+	return tree.new(root)
+}
+
+func checkKey(key []byte, pageSize int) error {
+	if len(key) == 0 {
+		return ErrEmptyKey // reserved for the dummy key
+	}
+	if len(key) > maxKeySize(pageSize) {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// the page size is a power of 2 so that the mmap chunks are aligned
+func checkPageSize(pageSize int) error {
+	if pageSize < BTREE_PAGE_SIZE_MIN || pageSize > BTREE_PAGE_SIZE_MAX || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("tinydb: bad page size %d", pageSize)
+	}
+	return nil
+}
 
+// the usable size of a node, the page ends with the checksum
+func nodeSize(pageSize int) int {
+	return pageSize - BTREE_PAGE_CHECKSUM
 }
 
-func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool) {
+// the limits are scaled down with smaller pages,
+// so that a node can always hold the largest KV.
+func maxKeySize(pageSize int) int {
+	return min(BTREE_PAGE_MAX_KEY_SIZE, pageSize*BTREE_PAGE_MAX_KEY_SIZE/BTREE_PAGE_SIZE)
+}
+
+// values larger than this are stored in overflow pages
+func maxInlineSize(pageSize int) int {
+	return pageSize * BTREE_PAGE_MAX_VALUE_SIZE / BTREE_PAGE_SIZE
+}
+
+// find the leaf containing the key
+func treeLookup(tree *BTree, node BNode, key []byte) (BNode, uint16, bool) {
 	idx := nodeLookupLE(node, key)
 
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
-			return nil, false
+		if !node.keyEqual(idx, key) {
+			return BNode{}, 0, false
 		}
-
-		val := node.getVal(idx)
-		return val, true
+		return node, idx, true
 	case BNODE_NODE:
 		ptr := node.getPtr(idx)
 		if ptr == 0 {
-			return nil, false
+			return BNode{}, 0, false
 		}
 		nextNode := tree.get(ptr)
-		return treeGet(tree, nextNode, key)
+		return treeLookup(tree, nextNode, key)
 	}
-	panic("bad node!")
+	panic(ErrCorrupted)
 }
 
-// insert a KV into a node, the result might be split into 2 nodes
+// insert a KV into a node, the result is split into 1-3 nodes
 // the caller is responsible for deallocating the input node
-// and splitting and allocating result nodes
-func treeInsert(tree *BTree, node BNode, key, val []byte) BNode {
+// and allocating result nodes
+func treeInsert(tree *BTree, node BNode, key, val []byte, overflow bool) []BNode {
 	// the result node
-	// it's allowed to be bigger than 1 page and will be split if so
-	newNode := NewBNode(make([]byte, BTREE_PAGE_SIZE<<1))
+	// it's allowed to be bigger than 1 page and will be split if so.
+	// the keys are expanded if the prefix is shortened by the new key.
+	newNode := NewBNode(make([]byte, tree.pageSize<<1))
 
 	// where to insert the key?
 	idx := nodeLookupLE(node, key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
+		if !leafFits(node, key, tree.pageSize) {
+			// the key is after all the keys, it's put in a new leaf
+			assert(idx == node.nkeys()-1, "the key is out of the node!")
+			right := NewBNode(make([]byte, tree.pageSize))
+			leafSingle(right, node, key, val)
+			if overflow {
+				right.setOverflow(0)
+			}
+			return []BNode{NewBNode(bytes.Clone(node.data)), right}
+		}
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		if node.keyEqual(idx, key) {
 			// found the key, update it
+			if node.isOverflow(idx) {
+				overflowFree(tree, node.getVal(idx))
+			}
 			leafUpdate(newNode, node, idx, key, val)
 		} else {
 			// insert it after
-			leafInsert(newNode, node, idx+1, key, val)
+			idx++
+			leafInsert(newNode, node, idx, key, val)
+		}
+		if overflow {
+			newNode.setOverflow(idx)
 		}
 	case BNODE_NODE:
 		// internal node, insert it to a kid node
-		nodeInsert(tree, newNode, node, idx, key, val)
+		nodeInsert(tree, newNode, node, idx, key, val, overflow)
 	default:
-		panic("bad node!")
+		panic(ErrCorrupted)
 	}
-	return newNode
+	nsplit, splitted := nodeSplit3(newNode, tree.pageSize)
+	return splitted[:nsplit]
 }
 
-// delete a key from the tree
+// delete a key from the tree, the result can be bigger than 1 page.
+// the first key of a kid can be longer after the deletion, which
+// replaces the key in the parent, the caller splits the result.
 func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	// where to find the key
 	idx := nodeLookupLE(node, key)
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if !node.keyEqual(idx, key) {
 			return BNode{} // not found
 		}
 		// delete the key in the leaf
-		newNode := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+		if node.isOverflow(idx) {
+			overflowFree(tree, node.getVal(idx))
+		}
+		newNode := NewBNode(make([]byte, tree.pageSize))
 		leafDelete(newNode, node, idx)
 		return newNode
 	case BNODE_NODE:
 		return nodeDelete(tree, node, idx, key)
 	default:
-		panic("bad node!")
+		panic(ErrCorrupted)
 	}
 }
 
@@ -169,16 +274,16 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 
 	tree.del(kptr)
 
-	newNode := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+	newNode := NewBNode(make([]byte, tree.pageSize<<1))
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	if mergeDir < 0 { // left
-		merged := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := NewBNode(make([]byte, tree.pageSize))
 		nodeMerge(merged, sibling, updated)
 		tree.del(node.getPtr(idx - 1))
 		nodeReplaceKid2(newNode, node, idx-1, tree.new(merged), merged.getKey(0))
 	} else if mergeDir > 0 { // right
-		merged := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+		merged := NewBNode(make([]byte, tree.pageSize))
 		nodeMerge(merged, updated, sibling)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplaceKid2(newNode, node, idx, tree.new(merged), merged.getKey(0))
@@ -190,29 +295,28 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 			newNode.setHeader(BNODE_NODE, 0)
 			// the empty node will be eliminated before reaching root.
 		} else {
-			nodeReplaceKidN(tree, newNode, node, idx, updated)
+			nsplit, splitted := nodeSplit3(updated, tree.pageSize)
+			nodeReplaceKidN(tree, newNode, node, idx, splitted[:nsplit]...)
 		}
 	}
 	return newNode
 }
 
 func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE>>2 {
+	if int(updated.nbytes()) > tree.pageSize>>2 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if nodeMergeSize(sibling, updated) <= nodeSize(tree.pageSize) {
 			return -1, sibling
 		}
 	}
 
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
-		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if nodeMergeSize(updated, sibling) <= nodeSize(tree.pageSize) {
 			return +1, sibling
 		}
 	}
@@ -227,17 +331,15 @@ func nodeReplaceKid2(new BNode, old BNode, idx uint16, merged uint64, key []byte
 	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
-func nodeInsert(tree *BTree, new, node BNode, idx uint16, key, val []byte) {
+func nodeInsert(tree *BTree, new, node BNode, idx uint16, key, val []byte, overflow bool) {
 	// get and deallocate the kid node
 	kptr := node.getPtr(idx)
 	knode := tree.get(kptr)
 	tree.del(kptr)
-	// recursive insertion to the kid node
-	knode = treeInsert(tree, knode, key, val)
-	// split the result
-	nsplit, splited := nodeSplit3(knode)
+	// recursive insertion to the kid node, the result is split
+	splited := treeInsert(tree, knode, key, val, overflow)
 	// update the kid links
-	nodeReplaceKidN(tree, new, node, idx, splited[:nsplit]...)
+	nodeReplaceKidN(tree, new, node, idx, splited...)
 }
 
 // replace a link with multiple links
@@ -0,0 +1,155 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// BIter is a cursor over the keys of a BTree in sorted order.
+// it keeps the path from the root to the current leaf,
+// the parent of `path[i+1]` is `path[i].getPtr(pos[i])`.
+type BIter struct {
+	tree *BTree
+	path []BNode  // from root to leaf
+	pos  []uint16 // indexes into nodes
+	err  error    // a bad page was read, the iterator is invalidated
+}
+
+// SeekLE find the closest position that is less or equal to the key
+func (tree *BTree) SeekLE(key []byte) (iter *BIter) {
+	iter = &BIter{tree: tree}
+	defer recoverPageError(&iter.err)
+	for ptr := tree.root; ptr != 0; {
+		node := tree.get(ptr)
+		idx := nodeLookupLE(node, key)
+		iter.path = append(iter.path, node)
+		iter.pos = append(iter.pos, idx)
+		if node.btype() == BNODE_NODE {
+			ptr = node.getPtr(idx)
+		} else {
+			ptr = 0
+		}
+	}
+	return iter
+}
+
+// Seek find the first position that is greater or equal to the key
+func (tree *BTree) Seek(key []byte) *BIter {
+	iter := tree.SeekLE(key)
+	if iter.Valid() && bytes.Equal(iter.Key(), key) {
+		return iter
+	}
+	// the current key is less than the key, or it's the dummy key
+	iter.Next()
+	return iter
+}
+
+// Valid reports whether the iterator points to a key.
+// it becomes invalid after moving past either end of the tree.
+func (iter *BIter) Valid() bool {
+	if iter.err != nil || len(iter.path) == 0 {
+		return false
+	}
+	leaf, pos := iter.leaf()
+	// the dummy key (empty) is the position before the first key
+	return pos < leaf.nkeys() && !leaf.keyEqual(pos, nil)
+}
+
+// Err return the error that invalidated the iterator
+func (iter *BIter) Err() error {
+	return iter.err
+}
+
+// Key get the current key
+func (iter *BIter) Key() []byte {
+	leaf, pos := iter.leaf()
+	return leaf.getKey(pos)
+}
+
+// Val get the current value.
+// it returns nil if the value in overflow pages can't be read, see Err.
+func (iter *BIter) Val() (val []byte) {
+	leaf, pos := iter.leaf()
+	if !leaf.isOverflow(pos) {
+		return leaf.getVal(pos)
+	}
+	defer recoverPageError(&iter.err)
+	return overflowRead(iter.tree, leaf.getVal(pos))
+}
+
+// the size of the current value without reading the overflow pages
+func (iter *BIter) valSize() int64 {
+	leaf, pos := iter.leaf()
+	val := leaf.getVal(pos)
+	if leaf.isOverflow(pos) {
+		return int64(binary.LittleEndian.Uint64(val[0:]))
+	}
+	return int64(len(val))
+}
+
+// Next move to the next key
+func (iter *BIter) Next() {
+	if iter.err != nil || len(iter.path) == 0 {
+		return
+	}
+	defer recoverPageError(&iter.err)
+	level := len(iter.path) - 1
+	if iter.pos[level] >= iter.path[level].nkeys() {
+		return // already past the last key
+	}
+	if !iterNext(iter, level) {
+		// past the last key
+		iter.pos[level] = iter.path[level].nkeys()
+	}
+}
+
+// Prev move to the previous key
+func (iter *BIter) Prev() {
+	if iter.err != nil || len(iter.path) == 0 {
+		return
+	}
+	defer recoverPageError(&iter.err)
+	// stops at the dummy key, which is the position before the first key
+	iterPrev(iter, len(iter.path)-1)
+}
+
+func (iter *BIter) leaf() (BNode, uint16) {
+	level := len(iter.path) - 1
+	return iter.path[level], iter.pos[level]
+}
+
+func iterNext(iter *BIter, level int) bool {
+	if iter.pos[level]+1 < iter.path[level].nkeys() {
+		iter.pos[level]++ // move within this node
+	} else if level > 0 && iterNext(iter, level-1) {
+		// move to a sibling node
+	} else {
+		return false // the last key
+	}
+
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = 0
+	}
+	return true
+}
+
+func iterPrev(iter *BIter, level int) bool {
+	if iter.pos[level] > 0 {
+		iter.pos[level]-- // move within this node
+	} else if level > 0 && iterPrev(iter, level-1) {
+		// move to a sibling node
+	} else {
+		return false // the first key
+	}
+
+	if level+1 < len(iter.pos) {
+		// update the kid node
+		kid := iter.tree.get(iter.path[level].getPtr(iter.pos[level]))
+		iter.path[level+1] = kid
+		iter.pos[level+1] = kid.nkeys() - 1
+	}
+	return true
+}
@@ -3,7 +3,9 @@ package tinydb
 import (
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"math/rand"
 	"slices"
+	"strings"
 	"testing"
 	"unsafe"
 )
@@ -16,24 +18,29 @@ type C struct {
 
 func newC() *C {
 	pages := map[uint64]BNode{}
-	return &C{
-		tree: BTree{
-			get: func(ptr uint64) BNode {
-				node, _ := pages[ptr]
-				return node
-			},
-			new: func(node BNode) uint64 {
-				key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
-				pages[key] = node
-				return key
-			},
-			del: func(ptr uint64) {
-				delete(pages, ptr)
-			},
-		},
+	c := &C{
 		ref:   map[string]string{},
 		pages: pages,
 	}
+	c.tree = BTree{
+		pageSize: BTREE_PAGE_SIZE,
+		get: func(ptr uint64) BNode {
+			node, _ := pages[ptr]
+			return node
+		},
+		new: func(node BNode) uint64 {
+			if t := node.btype(); (t == BNODE_NODE || t == BNODE_LEAF) && int(node.nbytes()) > nodeSize(c.tree.pageSize) {
+				panic("the node is larger than a page!")
+			}
+			key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
+			pages[key] = node
+			return key
+		},
+		del: func(ptr uint64) {
+			delete(pages, ptr)
+		},
+	}
+	return c
 }
 
 func (c *C) add(key string, val string) {
@@ -43,7 +50,8 @@ func (c *C) add(key string, val string) {
 
 func (c *C) del(key string) bool {
 	delete(c.ref, key)
-	return c.tree.Delete([]byte(key))
+	deleted, _ := c.tree.Delete([]byte(key))
+	return deleted
 }
 
 func (c *C) printTree() {
@@ -61,34 +69,303 @@ func TestBtree(t *testing.T) {
 	c.add("a", "1111")
 	require.NotNil(t, c.tree.root)
 
-	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.add("b", "2222")
-	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 1, 0, 4, 0, 98, 50, 50, 50, 50, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 1, 0, 4, 0, 98, 50, 50, 50, 50, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.add("b", "3333")
-	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 49, 49, 49, 49, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.add("a", "4444")
-	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.del("c")
-	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 22, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 1, 0, 4, 0, 98, 51, 51, 51, 51, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.del("b")
-	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 97, 52, 52, 52, 52, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.del("a")
-	copy(test, []byte{2, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 
 	c.add("d", "5555")
-	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 100, 53, 53, 53, 53, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	copy(test, []byte{2, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 0, 13, 0, 0, 0, 0, 0, 1, 0, 4, 0, 100, 53, 53, 53, 53, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
 	require.True(t, slices.Equal(test, c.tree.get(c.tree.root).data))
 }
+
+func (c *C) verifyIter(t *testing.T) {
+	keys := make([]string, 0, len(c.ref))
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	// forward
+	iter := c.tree.Seek([]byte{0})
+	for _, k := range keys {
+		require.True(t, iter.Valid())
+		require.Equal(t, k, string(iter.Key()))
+		require.Equal(t, c.ref[k], string(iter.Val()))
+		iter.Next()
+	}
+	require.False(t, iter.Valid())
+
+	// backward
+	for i := len(keys) - 1; i >= 0; i-- {
+		iter.Prev()
+		require.True(t, iter.Valid())
+		require.Equal(t, keys[i], string(iter.Key()))
+	}
+	iter.Prev()
+	require.False(t, iter.Valid())
+}
+
+func TestBtreeErrors(t *testing.T) {
+	c := newC()
+	require.ErrorIs(t, c.tree.Insert(nil, nil), ErrEmptyKey)
+	require.ErrorIs(t, c.tree.Insert(make([]byte, BTREE_PAGE_MAX_KEY_SIZE+1), nil), ErrKeyTooLarge)
+	_, _, err := c.tree.Get(nil)
+	require.ErrorIs(t, err, ErrEmptyKey)
+	_, err = c.tree.Delete(make([]byte, BTREE_PAGE_MAX_KEY_SIZE+1))
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+
+	// the largest KV
+	key := make([]byte, BTREE_PAGE_MAX_KEY_SIZE)
+	require.NoError(t, c.tree.Insert(key, make([]byte, BTREE_PAGE_MAX_VALUE_SIZE)))
+	val, ok, err := c.tree.Get(key)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Len(t, val, BTREE_PAGE_MAX_VALUE_SIZE)
+}
+
+func TestBtreeOverflow(t *testing.T) {
+	c := newC()
+	c.add("a", "1")
+	npages := len(c.pages)
+
+	sizes := []int{BTREE_PAGE_MAX_VALUE_SIZE + 1, overflowCap(BTREE_PAGE_SIZE), overflowCap(BTREE_PAGE_SIZE) + 1, 100000}
+	for _, size := range sizes {
+		val := make([]byte, size)
+		for i := range val {
+			val[i] = byte(i * 7)
+		}
+		require.NoError(t, c.tree.Insert([]byte("k"), val))
+		got, ok, err := c.tree.Get([]byte("k"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, val, got)
+
+		iter := c.tree.Seek([]byte("k"))
+		require.Equal(t, val, iter.Val())
+	}
+
+	// the chains are freed by overwrites and deletions
+	require.NoError(t, c.tree.Insert([]byte("k"), []byte("small")))
+	require.Equal(t, npages, len(c.pages))
+	require.NoError(t, c.tree.Insert([]byte("k"), make([]byte, 10000)))
+	require.Equal(t, npages+3, len(c.pages))
+	require.True(t, c.del("k"))
+	require.Equal(t, npages, len(c.pages))
+}
+
+func TestBtreeIter(t *testing.T) {
+	c := newC()
+	require.False(t, c.tree.Seek([]byte("a")).Valid())
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%d", (i*7919)%2000)
+		c.add(key, fmt.Sprintf("val%d", i))
+	}
+	c.verifyIter(t)
+
+	for i := 0; i < 2000; i += 3 {
+		require.True(t, c.del(fmt.Sprintf("key%d", i)))
+	}
+	c.verifyIter(t)
+
+	// Seek lands on the first key >= the given key
+	iter := c.tree.Seek([]byte("key10"))
+	require.Equal(t, "key10", string(iter.Key()))
+	iter = c.tree.Seek([]byte("key1000a"))
+	require.Equal(t, "key1001", string(iter.Key()))
+	iter = c.tree.Seek([]byte("kez"))
+	require.False(t, iter.Valid())
+	iter.Prev()
+	require.Equal(t, "key998", string(iter.Key()))
+
+	// SeekLE lands on the last key <= the given key
+	iter = c.tree.SeekLE([]byte("key1000a"))
+	require.Equal(t, "key1000", string(iter.Key()))
+	iter = c.tree.SeekLE([]byte("a"))
+	require.False(t, iter.Valid())
+	iter.Next()
+	require.Equal(t, "key1", string(iter.Key()))
+}
+
+func TestBtreeSequential(t *testing.T) {
+	c := newC()
+	for i := 0; i < 3000; i++ {
+		c.add(fmt.Sprintf("k%05d", i), "v")
+	}
+	c.verifyIter(t)
+
+	// the splits leave the leaves about half full
+	leaves := 0
+	for _, node := range c.pages {
+		if node.btype() == BNODE_LEAF {
+			leaves++
+		}
+	}
+	require.Less(t, leaves, 60)
+}
+
+func TestBtreeDeleteSeparator(t *testing.T) {
+	for _, pageSize := range []int{BTREE_PAGE_SIZE_MIN, 2048, BTREE_PAGE_SIZE} {
+		c := newC()
+		c.tree.pageSize = pageSize
+		long := strings.Repeat("x", maxKeySize(pageSize)-10)
+		// the short keys are the first keys of the leaves, deleting
+		// them replaces the keys of the parents with the long keys.
+		for i := 0; i < 2000; i++ {
+			c.add(fmt.Sprintf("k%05d", i), "v")
+			c.add(fmt.Sprintf("k%05d%s", i, long), "v")
+		}
+		for i := 0; i < 2000; i++ {
+			require.True(t, c.del(fmt.Sprintf("k%05d", i)))
+		}
+		c.verifyIter(t)
+
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			key := fmt.Sprintf("k%05d", rng.Intn(2000))
+			if rng.Intn(2) == 0 {
+				key += long[:rng.Intn(len(long))]
+			}
+			if rng.Intn(3) == 0 {
+				c.del(key)
+			} else {
+				c.add(key, "v")
+			}
+		}
+		c.verifyIter(t)
+	}
+}
+
+func TestBtreePrefix(t *testing.T) {
+	c := newC()
+	prefix := strings.Repeat("p", 200)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("%s%d/%s%d", prefix, i%10, prefix, (i*7919)%2000)
+		c.add(key, fmt.Sprintf("val%d", i))
+	}
+	c.verifyIter(t)
+
+	// the keys are stored without the common prefix
+	compressed, stored, raw := 0, 0, 0
+	for _, node := range c.pages {
+		if node.btype() != BNODE_LEAF {
+			continue
+		}
+		if len(node.getPrefix()) > 200 {
+			compressed++
+		}
+		stored += int(node.nbytes())
+		for i := uint16(0); i < node.nkeys(); i++ {
+			raw += len(node.getKey(i))
+		}
+	}
+	require.Greater(t, compressed, 0)
+	require.Less(t, stored, raw/2)
+
+	for key, val := range c.ref {
+		got, ok, err := c.tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, val, string(got))
+	}
+	_, ok, err := c.tree.Get([]byte(prefix + "5/"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// merged nodes have a shorter prefix
+	for i := 0; i < 2000; i++ {
+		if i%10 != 0 || i%7 == 0 {
+			key := fmt.Sprintf("%s%d/%s%d", prefix, i%10, prefix, (i*7919)%2000)
+			require.True(t, c.del(key))
+		}
+	}
+	c.verifyIter(t)
+
+	// a key that would expand the leaf too much is put in a new leaf
+	c = newC()
+	prefix = strings.Repeat("A", 900)
+	for i := 0; i < 500; i++ {
+		c.add(fmt.Sprintf("%s%04d", prefix, i), "")
+	}
+	c.add("B", "x")
+	c.add("C", "y")
+	c.add(prefix+"B", "z")
+	c.verifyIter(t)
+}
+
+func TestFreelist(t *testing.T) {
+	pages := map[uint64]BNode{}
+	owned := map[uint64]bool{} // the pages of the list, both the nodes and the pointers
+	next := uint64(0)
+	fl := Freelist{
+		pageSize: BTREE_PAGE_SIZE_MIN,
+		get:      func(ptr uint64) BNode { return pages[ptr] },
+		new: func(node BNode) uint64 {
+			next++
+			pages[next] = node
+			owned[next] = true
+			return next
+		},
+		use: func(ptr uint64, node BNode) { pages[ptr] = node },
+	}
+	fl.head = fl.new(NewBNode(make([]byte, BTREE_PAGE_SIZE_MIN)))
+
+	// the sizes around the node capacity
+	var used []uint64
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 2000; round++ {
+		popn := rng.Intn(int(fl.Total()) + 1)
+		var freed []uint64
+		for n := rng.Intn(3 * fl.cap()); n > 0 && len(used) > 0; n-- {
+			freed = append(freed, used[len(used)-1])
+			used = used[:len(used)-1]
+		}
+		for n := rng.Intn(fl.cap()); n > 0; n-- {
+			next++
+			freed = append(freed, next)
+		}
+		for i := 0; i < popn; i++ {
+			ptr := fl.Get(i)
+			delete(owned, ptr)
+			used = append(used, ptr)
+		}
+		for _, ptr := range freed {
+			owned[ptr] = true
+		}
+		fl.Update(popn, freed)
+
+		got, total := map[uint64]bool{}, 0
+		for ptr := fl.head; ptr != 0; ptr = flnNext(pages[ptr]) {
+			got[ptr] = true
+			for i := 0; i < flnSize(pages[ptr]); i++ {
+				got[flnPtr(pages[ptr], i)] = true
+				total++
+			}
+		}
+		require.Equal(t, owned, got)
+		require.Equal(t, uint64(total), fl.Total())
+	}
+}
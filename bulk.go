@@ -0,0 +1,416 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// BulkIter the input of the bulk loader, a KVIter is also a BulkIter
+type BulkIter interface {
+	Valid() bool
+	Key() []byte
+	Val() []byte
+	Next()
+	Err() error
+}
+
+// BulkOptions of KV.BulkLoad, nil for the defaults
+type BulkOptions struct {
+	// how full the new pages are, in (0, 1], 0 for 1.
+	// a lower factor leaves room for the later inserts.
+	FillFactor float64
+	// fail with ErrUnsorted if a key is not greater than the previous one,
+	// otherwise such keys are inserted one by one after the load.
+	Strict bool
+}
+
+// BulkLoad add the sorted KVs in a single commit, the existing keys are
+// replaced. instead of inserting the keys one by one, the tree is rebuilt
+// bottom-up from the input merged with the existing keys, the new pages
+// are packed and appended to the file without reusing the free pages.
+// only the pages overlapping the input are rewritten, the subtrees between
+// or after the input keys are linked as they are. so the cost is about the
+// input size plus a path of the tree for each gap in the input, loading
+// keys scattered across a large tree still rewrites most of it.
+func (db *KV) BulkLoad(iter BulkIter, opts *BulkOptions) error {
+	if db.ReadOnly {
+		return ErrReadOnly
+	}
+	version, err := bulkCommit(db, iter, opts, true)
+	if err != nil || db.Sync != SYNC_GROUP {
+		return err
+	}
+	return groupSync(db, version)
+}
+
+func bulkCommit(db *KV, iter BulkIter, opts *BulkOptions, replace bool) (uint64, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	if opts.FillFactor < 0 || opts.FillFactor > 1 {
+		return 0, fmt.Errorf("tinydb: bad fill factor %v", opts.FillFactor)
+	}
+	fill := opts.FillFactor
+	if fill == 0 {
+		fill = 1
+	}
+	if !iter.Valid() {
+		return 0, iter.Err()
+	}
+
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	b := &bulkBuilder{
+		db:      db,
+		limit:   int(float64(nodeSize(db.PageSize)) * fill),
+		iter:    iter,
+		strict:  opts.Strict,
+		replace: replace,
+	}
+	b.tree = BTree{pageSize: db.PageSize, get: db.pageGet, new: b.pageNew, del: db.pageDel}
+
+	saved := saveState(db)
+	err := bulkApply(db, b)
+	if err == nil {
+		err = commitPages(db)
+	}
+	if err == nil && db.WAL {
+		// the pages are not logged
+		err = checkpoint(db)
+	}
+	if err != nil {
+		restoreState(db, saved)
+		return 0, err
+	}
+	return publishVersion(db, committedTX{bulk: &keyRange{start: b.start, stop: b.stop}}), nil
+}
+
+// rebuild the tree with the input and insert the unsorted keys
+func bulkApply(db *KV, b *bulkBuilder) (err error) {
+	defer recoverPageError(&err)
+	b.add(0, nil, nil, 0, false) // the dummy key
+	if db.tree.root != 0 {
+		height := 0
+		for node := db.tree.get(db.tree.root); node.btype() == BNODE_NODE; node = db.tree.get(node.getPtr(0)) {
+			height++
+		}
+		b.merge(db.tree.root, height, nil)
+	}
+	b.feed(nil)
+	if b.err != nil {
+		return b.err
+	}
+	db.tree.root = b.finish()
+	if b.err != nil {
+		return b.err
+	}
+	for i, key := range b.rest {
+		if err := db.tree.insert(key, b.restVals[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// builds a tree from the sorted KVs bottom-up. each level keeps the KVs
+// of its last node, which is written when the next KV doesn't fit.
+type bulkBuilder struct {
+	db      *KV
+	tree    BTree // allocates the pages at the end of the file
+	limit   int   // the node size by the fill factor
+	levels  []bulkNode
+	iter    BulkIter
+	strict  bool
+	replace bool   // replace the existing keys or fail
+	prev    []byte // the last key from the input
+	// the keys out of order, inserted after the load
+	rest     [][]byte
+	restVals [][]byte
+	// the range of the input keys
+	start []byte
+	stop  []byte
+	err   error
+}
+
+// the KVs of a node being built
+type bulkNode struct {
+	keys     [][]byte
+	vals     [][]byte
+	ptrs     []uint64
+	overflow []bool
+	nbytes   int // the size of the KVs with the full keys
+}
+
+// callback for the tree, write a new page at the end of the file
+func (b *bulkBuilder) pageNew(node BNode) uint64 {
+	if b.err != nil {
+		return 0
+	}
+	ptr, err := pageReserve(b.db)
+	if err == nil {
+		err = pageWrite(b.db, ptr, node)
+	}
+	if err != nil {
+		b.err = err
+		return 0
+	}
+	return ptr
+}
+
+// merge the KVs of the old tree with the input, and free the rewritten
+// pages. the node is at the level of the builder, its keys are below stop.
+func (b *bulkBuilder) merge(ptr uint64, level int, stop []byte) {
+	node := b.db.tree.get(ptr)
+	for i := uint16(0); i < node.nkeys() && b.err == nil; i++ {
+		if node.btype() == BNODE_NODE {
+			key, kidStop := node.getKey(i), stop
+			if i+1 < node.nkeys() {
+				kidStop = node.getKey(i + 1)
+			}
+			b.feed(key)
+			if b.err != nil {
+				return
+			}
+			// the kid holding the dummy key is always rewritten
+			if len(key) > 0 && b.skips(kidStop) {
+				b.link(level-1, key, node.getPtr(i))
+			} else {
+				b.merge(node.getPtr(i), level-1, kidStop)
+			}
+			continue
+		}
+		key := node.getKey(i)
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		b.feed(key)
+		if b.iter.Valid() && bytes.Equal(b.iter.Key(), key) {
+			if !b.replace {
+				b.err = checkUpdateMode(key, true, MODE_INSERT_ONLY)
+				return
+			}
+			// replaced by the input
+			if node.isOverflow(i) {
+				overflowFree(&b.db.tree, node.getVal(i))
+			}
+			continue
+		}
+		// the pages of the old tree are not overwritten before the commit
+		b.add(0, key, node.getVal(i), 0, node.isOverflow(i))
+	}
+	b.db.tree.del(ptr)
+}
+
+// whether the input has no keys before stop, nil for the end
+func (b *bulkBuilder) skips(stop []byte) bool {
+	return !b.iter.Valid() || (stop != nil && bytes.Compare(stop, b.iter.Key()) <= 0)
+}
+
+// link an old subtree whose root is at the level, the pending nodes
+// below it are written first to keep the keys in order.
+func (b *bulkBuilder) link(level int, key []byte, ptr uint64) {
+	for l := 0; l <= level && l < len(b.levels); l++ {
+		if len(b.levels[l].keys) > 0 {
+			b.flush(l)
+		}
+	}
+	b.add(level+1, key, nil, ptr, false)
+}
+
+// add the input KVs that are less than the key, nil for all of them
+func (b *bulkBuilder) feed(until []byte) {
+	for ; b.err == nil && b.iter.Valid(); b.iter.Next() {
+		key, val := b.iter.Key(), b.iter.Val()
+		if until != nil && bytes.Compare(key, until) >= 0 {
+			return
+		}
+		b.input(key, val)
+	}
+	if b.err == nil {
+		b.err = b.iter.Err()
+	}
+}
+
+func (b *bulkBuilder) input(key, val []byte) {
+	if err := checkKey(key, b.tree.pageSize); err != nil {
+		b.err = err
+		return
+	}
+	if len(val) > BTREE_MAX_VALUE_SIZE {
+		b.err = ErrValueTooLarge
+		return
+	}
+	key = bytes.Clone(key)
+	if b.start == nil || bytes.Compare(key, b.start) < 0 {
+		b.start = key
+	}
+	if bytes.Compare(key, b.stop) > 0 {
+		b.stop = key
+	}
+
+	if b.prev != nil && bytes.Compare(key, b.prev) <= 0 {
+		if b.strict {
+			b.err = fmt.Errorf("%w: %q", ErrUnsorted, key)
+			return
+		}
+		b.rest = append(b.rest, key)
+		b.restVals = append(b.restVals, bytes.Clone(val))
+		return
+	}
+	b.prev = key
+
+	overflow := len(val) > maxInlineSize(b.tree.pageSize)
+	if overflow {
+		val = overflowWrite(&b.tree, val)
+	} else {
+		val = bytes.Clone(val)
+	}
+	b.add(0, key, val, 0, overflow)
+}
+
+// append a KV to the level, write the node first if it's full
+func (b *bulkBuilder) add(level int, key, val []byte, ptr uint64, overflow bool) {
+	for level >= len(b.levels) {
+		b.levels = append(b.levels, bulkNode{})
+	}
+	n := &b.levels[level]
+	if count := len(n.keys) + 1; count > 1 {
+		plen := len(leafPrefix(bulkType(level), n.keys[0], key))
+		size := HEADER + 2 + plen + 10*count + 4*count + n.nbytes + len(key) + len(val) - plen*count
+		// at least 2 keys in a node, so that the levels converge
+		if size > nodeSize(b.tree.pageSize) || (size > b.limit && count > 2) {
+			b.flush(level)
+			n = &b.levels[level]
+		}
+	}
+	n.keys = append(n.keys, key)
+	n.vals = append(n.vals, val)
+	n.ptrs = append(n.ptrs, ptr)
+	n.overflow = append(n.overflow, overflow)
+	n.nbytes += len(key) + len(val)
+}
+
+// write the node of the level and link it to the parent
+func (b *bulkBuilder) flush(level int) {
+	key := b.levels[level].keys[0]
+	ptr := b.write(level)
+	b.levels[level] = bulkNode{}
+	b.add(level+1, key, nil, ptr, false)
+}
+
+func (b *bulkBuilder) write(level int) uint64 {
+	n := &b.levels[level]
+	btype := bulkType(level)
+	node := NewBNode(make([]byte, b.tree.pageSize))
+	node.setHeader(btype, uint16(len(n.keys)))
+	node.setPrefix(leafPrefix(btype, n.keys[0], n.keys[len(n.keys)-1]))
+	for i, key := range n.keys {
+		nodeAppendKV(node, uint16(i), n.ptrs[i], key, n.vals[i])
+		if n.overflow[i] {
+			node.setOverflow(uint16(i))
+		}
+	}
+	return b.tree.new(node)
+}
+
+// write the remaining nodes, the top level is the root.
+// the lower levels can be empty after linking an old subtree.
+func (b *bulkBuilder) finish() uint64 {
+	for level := 0; ; level++ {
+		n := &b.levels[level]
+		if level == len(b.levels)-1 {
+			if level > 0 && len(n.keys) == 1 {
+				return n.ptrs[0] // a single kid is the root
+			}
+			return b.write(level)
+		}
+		if len(n.keys) > 0 {
+			b.flush(level)
+		}
+	}
+}
+
+func bulkType(level int) uint16 {
+	if level == 0 {
+		return BNODE_LEAF
+	}
+	return BNODE_NODE
+}
+
+// a BulkIter over the sorted KVs in memory
+type sliceIter struct {
+	keys [][]byte
+	vals [][]byte
+	pos  int
+}
+
+func (it *sliceIter) Valid() bool { return it.pos < len(it.keys) }
+func (it *sliceIter) Key() []byte { return it.keys[it.pos] }
+func (it *sliceIter) Val() []byte { return it.vals[it.pos] }
+func (it *sliceIter) Next()       { it.pos++ }
+func (it *sliceIter) Err() error  { return nil }
+
+// BulkInsert add the rows with the bulk loader, see KV.BulkLoad.
+// the rows, their index keys, and the blobs are sorted in memory,
+// it fails if any of the rows exists.
+func (db *DB) BulkInsert(table string, rows []Record) error {
+	if db.kv.ReadOnly {
+		return ErrReadOnly
+	}
+	tx := db.Begin()
+	tdef, err := getTableDef(tx, table)
+	tx.Abort()
+	if err != nil {
+		return err
+	}
+
+	it := &sliceIter{}
+	add := func(key, val []byte) {
+		it.keys = append(it.keys, key)
+		it.vals = append(it.vals, val)
+	}
+	for _, rec := range rows {
+		values, err := checkRecord(tdef, rec, len(tdef.Cols))
+		if err != nil {
+			return err
+		}
+		pkeys := values[:tdef.PKeys]
+		for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+			if tdef.Types[i] == TYPE_BLOB {
+				key := blobKey(tdef, pkeys, i)
+				if values[i].Str != nil {
+					add(key, values[i].Str)
+				}
+				values[i].Str = key
+			}
+		}
+		add(encodeKey(nil, tdef.Prefix, pkeys), encodeValues(nil, values[tdef.PKeys:]))
+		for i := range tdef.Indexes {
+			add(indexKey(tdef, i, values), nil)
+		}
+	}
+	order := make([]int, len(it.keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(i, j int) int {
+		return bytes.Compare(it.keys[i], it.keys[j])
+	})
+	sorted := &sliceIter{}
+	for _, i := range order {
+		key := it.keys[i]
+		if n := len(sorted.keys); n > 0 && bytes.Equal(sorted.keys[n-1], key) {
+			return checkUpdateMode(key, true, MODE_INSERT_ONLY) // duplicated rows
+		}
+		sorted.keys = append(sorted.keys, key)
+		sorted.vals = append(sorted.vals, it.vals[i])
+	}
+
+	version, err := bulkCommit(db.kv, sorted, &BulkOptions{Strict: true}, false)
+	if err != nil || db.kv.Sync != SYNC_GROUP {
+		return err
+	}
+	return groupSync(db.kv, version)
+}
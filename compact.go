@@ -0,0 +1,320 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"syscall"
+)
+
+// Compact shrink the file and return the number of bytes reclaimed.
+// the pages of the tree are moved to the free pages toward the start of
+// the file, the free list is rebuilt with the free pages below the cut,
+// and the file is truncated at the cut. the parents of the moved pages
+// are copied too, so this is repeated with the pages they freed until
+// nothing is reclaimed. the moved pages are still
+// visible to the running readers, the file is truncated only if there
+// are no readers of the older versions, otherwise call it again later.
+// the pages visible to the readers and the pages reserved by BlobWriter
+// are not moved.
+func (db *KV) Compact() (int64, error) {
+	if db.ReadOnly {
+		return 0, ErrReadOnly
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	total := int64(0)
+	for {
+		if db.deferred() {
+			// update the free list
+			if err := checkpoint(db); err != nil {
+				return total, err
+			}
+		}
+		cut, err := compactMove(db)
+		if err != nil {
+			return total, err
+		}
+		reclaimed, err := compactTruncate(db, cut)
+		total += reclaimed
+		if err != nil || reclaimed == 0 {
+			return total, err
+		}
+	}
+}
+
+// move the pages until the cut no longer goes down, return the cut
+func compactMove(db *KV) (uint64, error) {
+	cut := db.page.flushed
+	for {
+		saved := saveState(db)
+		next, err := compactApply(db)
+		if err == nil && next < cut {
+			err = flushPages(db)
+		}
+		if err != nil {
+			restoreState(db, saved)
+			return 0, err
+		}
+		if next >= cut {
+			restoreState(db, saved) // the releases of the pinned pages
+			return cut, nil
+		}
+		publishVersion(db, committedTX{})
+		if db.page.flushed != saved.flushed {
+			return db.page.flushed, nil // a page is appended to the free list, rare
+		}
+		cut = next
+	}
+}
+
+// moves the pages below the cut
+type compactor struct {
+	db    *KV
+	cut   uint64
+	holes []uint64 // the free pages below the cut, sorted
+	dry   bool     // only count the moves
+	moves int
+}
+
+// move the pages and rebuild the free list, return the cut.
+// the pages above the cut are freed, they are truncated later.
+func compactApply(db *KV) (cut uint64, err error) {
+	defer recoverPageError(&err)
+	v := verifyPages(db)
+	if len(v.errs) > 0 {
+		return 0, errors.Join(v.errs...)
+	}
+	owners := v.owners
+	for _, ptr := range releasePages(db, nil) {
+		owners[ptr] = PAGE_FREE // no longer visible to the readers
+	}
+
+	// the pinned and the leaked pages can't be moved
+	low := uint64(1)
+	for ptr, owner := range owners {
+		if owner == PAGE_PINNED || owner == PAGE_UNUSED {
+			low = uint64(ptr) + 1
+		}
+	}
+	// the nodes of the old free list are not overwritten before
+	// the master page is updated, they are only added to the new list.
+	free := func(cut uint64) (holes, nodes []uint64) {
+		for ptr := uint64(1); ptr < cut; ptr++ {
+			switch owners[ptr] {
+			case PAGE_FREE:
+				holes = append(holes, ptr)
+			case PAGE_FREE_LIST:
+				nodes = append(nodes, ptr)
+			}
+		}
+		return holes, nodes
+	}
+
+	// the lowest cut with enough holes for the moves and the new free list
+	c := &compactor{db: db, dry: true}
+	flushed := db.page.flushed
+	n := sort.Search(int(flushed-low), func(i int) bool {
+		c.cut, c.moves = low+uint64(i), 0
+		if db.tree.root != 0 {
+			c.node(db.tree.root)
+		}
+		holes, nodes := free(c.cut)
+		rest := len(holes) - c.moves
+		return rest > 0 && rest*db.free.cap() >= len(nodes) // see flBuild
+	})
+	c.cut, c.dry = low+uint64(n), false
+	if c.cut >= flushed {
+		return flushed, nil
+	}
+
+	holes, nodes := free(c.cut)
+	c.holes = holes
+	if db.tree.root != 0 {
+		db.tree.root = c.node(db.tree.root)
+	}
+	flBuild(&db.free, append(c.holes, nodes...))
+	// pinned until the truncation, in case it's not done
+	for ptr := c.cut; ptr < flushed; ptr++ {
+		if owners[ptr] == PAGE_FREE || owners[ptr] == PAGE_FREE_LIST {
+			db.pageDel(ptr)
+		}
+	}
+	return c.cut, nil
+}
+
+type compactPatch struct {
+	idx uint16
+	ptr uint64
+}
+
+// move the subtree below the cut, return the new pointer.
+// a page is moved if it's above the cut or any of its kids is moved.
+func (c *compactor) node(ptr uint64) uint64 {
+	node := c.db.tree.get(ptr)
+	var patches []compactPatch
+	for i := uint16(0); i < node.nkeys(); i++ {
+		if node.btype() == BNODE_NODE {
+			if kid := c.node(node.getPtr(i)); kid != node.getPtr(i) {
+				patches = append(patches, compactPatch{i, kid})
+			}
+		} else if node.isOverflow(i) {
+			head := binary.LittleEndian.Uint64(node.getVal(i)[8:])
+			if moved := c.overflow(head); moved != head {
+				patches = append(patches, compactPatch{i, moved})
+			}
+		}
+	}
+	if ptr < c.cut && len(patches) == 0 {
+		return ptr
+	}
+	if !c.dry {
+		node = NewBNode(bytes.Clone(node.data))
+		for _, p := range patches {
+			if node.btype() == BNODE_NODE {
+				node.setPtr(p.idx, p.ptr)
+			} else {
+				binary.LittleEndian.PutUint64(node.getVal(p.idx)[8:], p.ptr)
+			}
+		}
+	}
+	return c.move(ptr, node)
+}
+
+// move an overflow chain from the tail, return the new head
+func (c *compactor) overflow(head uint64) uint64 {
+	var ptrs []uint64
+	for ptr := head; ptr != 0; {
+		ptrs = append(ptrs, ptr)
+		ptr = binary.LittleEndian.Uint64(overflowGet(&c.db.tree, ptr).data[4:])
+	}
+	next := uint64(0) // the new pointer of the next page
+	for i := len(ptrs) - 1; i >= 0; i-- {
+		ptr, old := ptrs[i], uint64(0)
+		if i+1 < len(ptrs) {
+			old = ptrs[i+1]
+		}
+		if ptr < c.cut && next == old {
+			next = ptr
+			continue
+		}
+		node := overflowGet(&c.db.tree, ptr)
+		if !c.dry {
+			node = NewBNode(bytes.Clone(node.data))
+			binary.LittleEndian.PutUint64(node.data[4:], next)
+		}
+		next = c.move(ptr, node)
+	}
+	return next
+}
+
+// move the page to the lowest hole. the dry run returns 0,
+// which differs from any page, so that the parents are moved.
+func (c *compactor) move(ptr uint64, node BNode) uint64 {
+	c.moves++
+	if c.dry {
+		return 0
+	}
+	assert(len(c.holes) > 0, "no holes to move to!")
+	hole := c.holes[0]
+	c.holes = c.holes[1:]
+	c.db.pageUse(hole, node)
+	c.db.pageDel(ptr)
+	return hole
+}
+
+// rebuild the free list with the free pages, the nodes are written to
+// the pages from the front, N pages take ceil(N / (cap+1)) nodes.
+func flBuild(fl *Freelist, ptrs []uint64) {
+	assert(len(ptrs) > 0, "no page for the free list!")
+	fl.head = 0
+	total := 0
+	for fl.head == 0 || len(ptrs) > 0 {
+		ptr := ptrs[0]
+		size := min(len(ptrs)-1, fl.cap())
+		node := NewBNode(make([]byte, fl.pageSize))
+		flnSetHeader(node, uint16(size), fl.head)
+		for i, item := range ptrs[1 : 1+size] {
+			flnSetPtr(node, i, item)
+		}
+		ptrs = ptrs[1+size:]
+		total += size
+		fl.use(ptr, node)
+		fl.head = ptr
+	}
+	flnSetTotal(fl.get(fl.head), uint64(total))
+}
+
+// truncate the file at the cut if no reader sees the pages above it
+func compactTruncate(db *KV, cut uint64) (int64, error) {
+	db.mu.Lock()
+	busy := false
+	for r := range db.readers {
+		busy = busy || r.version < db.version
+	}
+	db.mu.Unlock()
+	// the pages above the cut can be visible to other processes
+	defer unlockReaders(db)
+	if busy || !lockReaders(db) {
+		return 0, nil
+	}
+
+	if cut < db.page.flushed {
+		saved := saveState(db)
+		// the moved pages above the cut are dropped instead of being freed
+		var pinned []pinnedPages
+		for _, p := range db.pinned {
+			ptrs := slices.DeleteFunc(slices.Clone(p.ptrs), func(ptr uint64) bool { return ptr >= cut })
+			if len(ptrs) > 0 {
+				pinned = append(pinned, pinnedPages{version: p.version, ptrs: ptrs})
+			}
+		}
+		db.mu.Lock()
+		db.pinned = pinned
+		db.mu.Unlock()
+		db.page.flushed = cut
+		if err := checkpoint(db); err != nil {
+			restoreState(db, saved)
+			return 0, err
+		}
+	}
+
+	size := int(db.page.flushed) * db.PageSize
+	reclaimed := int64(db.mmap.file - size)
+	if reclaimed <= 0 {
+		return 0, nil
+	}
+	if err := db.fp.Truncate(int64(size)); err != nil {
+		return 0, fmt.Errorf("truncate: %w", err)
+	}
+	if err := db.fp.Sync(); err != nil {
+		return 0, fmt.Errorf("fsync: %w", err)
+	}
+	db.mmap.file = size
+	return reclaimed, compactRemap(db)
+}
+
+// replace the mmap with a smaller one if there are no readers
+func compactRemap(db *KV) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(db.readers) > 0 {
+		return nil // the mmap beyond the file is not accessed
+	}
+	_, chunk, err := mmapInit(db.fp, db.MmapSize, db.MaxMmapSize, syscall.PROT_READ|syscall.PROT_WRITE)
+	if err != nil {
+		return err
+	}
+	for _, old := range db.mmap.chunks {
+		if err := syscall.Munmap(old); err != nil {
+			db.Logger.Printf("tinydb: compact %s: munmap: %v", db.Path, err)
+		}
+	}
+	db.mmap.total = len(chunk)
+	db.mmap.chunks = [][]byte{chunk}
+	return nil
+}
@@ -1,22 +1,26 @@
 package tinydb
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
 )
 
-const TABLE_PREFIX_MIN = 0
+const TABLE_PREFIX_MIN = 100
 
 type DB struct {
 	Path string
 	// internals
 	kv     *KV
+	mu     sync.Mutex           // protects the cache below
 	tables map[string]*TableDef // cached table definition
 }
 
-func Open(Path string) (*DB, error) {
-	kv, err := NewDB(Path)
+// Open open or create a database, nil options for the defaults
+func Open(Path string, opts *Options) (*DB, error) {
+	kv, err := NewDB(Path, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -31,61 +35,48 @@ func (db *DB) Close() {
 	db.kv.Close()
 }
 
+// TableNew create a new table.
+// the assigned prefixes are set in the definition after the commit.
 func (db *DB) TableNew(tdef *TableDef) error {
-	if err := tableDefCheck(tdef); err != nil {
+	var created *TableDef
+	err := retryTX(db, func(tx *DBTX) (err error) {
+		created, err = tableNew(tx, tdef)
 		return err
+	})
+	if err == nil {
+		*tdef = *created
 	}
-	// check the existing table
-	table := (&Record{}).AddStr("name", []byte(tdef.Name))
-	ok, err := dbGet(db, TDEF_TABLE, table)
-	assert(err == nil, "error never happened")
-	if ok {
-		return fmt.Errorf("table exists: %s", tdef.Name)
-	}
-	// allocate a new prefix
-	assert(tdef.Prefix == 0, "tdef prefix should be 0")
-	tdef.Prefix = TABLE_PREFIX_MIN
-	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
-	ok, err = dbGet(db, TDEF_META, meta)
-	assert(err == nil, "error never happened")
-	if ok {
-		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
-		assert(tdef.Prefix > TABLE_PREFIX_MIN, "bad tdef prefix")
-	} else {
-		meta.AddStr("val", make([]byte, 4))
-	}
-	// update the next prefix
-	binary.LittleEndian.PutUint32(meta.Get("val").Str, tdef.Prefix+1)
-	_, err = dbUpdate(db, TDEF_META, *meta, MODE_UPSERT)
-	if err != nil {
-		return err
-	}
-
-	// store the definition
-	val, err := json.Marshal(tdef)
-	assert(err == nil, "error never happened")
-	table.AddStr("def", val)
-	_, err = dbUpdate(db, TDEF_TABLE, *table, MODE_UPSERT)
 	return err
 }
 
 // Get get a single row by the primary key
 func (db *DB) Get(table string, rec *Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table %s not found", table)
-	}
+	tx := db.Begin()
+	ok, err := tx.Get(table, rec)
+	return ok, endTX(tx, err)
+}
 
-	return dbGet(db, tdef, rec)
+// Scan range query on the primary key or an index, see Scanner.
+// the scanner reads a snapshot until it's exhausted or closed.
+func (db *DB) Scan(table string, start, end Record, cmp1, cmp2 int) (*Scanner, error) {
+	tx := db.Begin()
+	sc, err := tx.Scan(table, start, end, cmp1, cmp2)
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	sc.owned = true // the scanner ends the transaction
+	return sc, nil
 }
 
 // Set add a record
 func (db *DB) Set(table string, rec Record, mode UpdateMode) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
-	}
-	return dbUpdate(db, tdef, rec, mode)
+	var ok bool
+	err := retryTX(db, func(tx *DBTX) (err error) {
+		ok, err = tx.Set(table, rec, mode)
+		return err
+	})
+	return ok, err
 }
 
 func (db *DB) Insert(table string, rec Record) (bool, error) {
@@ -101,43 +92,91 @@ func (db *DB) Upsert(table string, rec Record) (bool, error) {
 }
 
 func (db *DB) Delete(table string, rec Record) (bool, error) {
-	tdef := getTableDef(db, table)
-	if tdef == nil {
-		return false, fmt.Errorf("table not found: %s", table)
+	var ok bool
+	err := retryTX(db, func(tx *DBTX) (err error) {
+		ok, err = tx.Delete(table, rec)
+		return err
+	})
+	return ok, err
+}
+
+// commit the single-operation transaction if the operation succeeded
+func endTX(tx *DBTX, err error) error {
+	if err != nil {
+		tx.Abort()
+		return err
 	}
-	return dbDelete(db, tdef, rec)
+	return tx.Commit()
 }
 
-func tableDefCheck(tdef *TableDef) error {
-	return nil
+// run a single-operation transaction, retry it on conflicts
+func retryTX(db *DB, fn func(tx *DBTX) error) error {
+	for {
+		tx := db.Begin()
+		err := endTX(tx, fn(tx))
+		if !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
 }
 
-// get the table definition by name
-func getTableDef(db *DB, table string) *TableDef {
-	tdef, ok := db.tables[table]
-	if !ok {
-		if db.tables == nil {
-			db.tables = make(map[string]*TableDef)
+func tableDefCheck(tdef *TableDef) error {
+	bad := tdef.Name == "" || len(tdef.Cols) == 0 || len(tdef.Cols) != len(tdef.Types)
+	bad = bad || !(1 <= tdef.PKeys && tdef.PKeys <= len(tdef.Cols))
+	if bad {
+		return fmt.Errorf("tinydb: bad table definition: %s", tdef.Name)
+	}
+	for i, col := range tdef.Cols {
+		switch tdef.Types[i] {
+		case TYPE_BYTES, TYPE_INT64:
+		case TYPE_BLOB:
+			if i < tdef.PKeys {
+				return fmt.Errorf("tinydb: blob in the primary key: %s", col)
+			}
+		default:
+			return fmt.Errorf("tinydb: invalid column type: %s", col)
 		}
-		tdef = getTableDefDB(db, table)
-		if tdef != nil {
-			db.tables[table] = tdef
+		if slices.Index(tdef.Cols, col) != i {
+			return fmt.Errorf("tinydb: duplicated column: %s", col)
 		}
 	}
+	return indexDefCheck(tdef)
+}
 
-	return tdef
+// get the table definition by name
+func getTableDef(tx *DBTX, table string) (*TableDef, error) {
+	tx.db.mu.Lock()
+	tdef, ok := tx.db.tables[table]
+	tx.db.mu.Unlock()
+	if ok {
+		return tdef, nil
+	}
+	tdef, ok = tx.tables[table]
+	if ok {
+		return tdef, nil
+	}
+	tdef, err := getTableDefDB(tx, table)
+	if err != nil {
+		return nil, err
+	}
+	if tdef == nil {
+		return nil, fmt.Errorf("table not found: %s", table)
+	}
+	tx.tables[table] = tdef
+	return tdef, nil
 }
 
-func getTableDefDB(db *DB, table string) *TableDef {
+func getTableDefDB(tx *DBTX, table string) (*TableDef, error) {
 	rec := (&Record{}).AddStr("name", []byte(table))
-	ok, err := dbGet(db, TDEF_TABLE, rec)
-	assert(err == nil, "error must never happened")
-	if !ok {
-		return nil
+	ok, err := dbGet(tx, TDEF_TABLE, rec)
+	if err != nil || !ok {
+		return nil, err
 	}
 
 	tdef := &TableDef{}
 	err = json.Unmarshal(rec.Get("def").Str, tdef)
-	assert(err == nil, "error must never happened")
-	return tdef
+	if err != nil {
+		return nil, fmt.Errorf("%w: table %s: %v", ErrCorrupted, table, err)
+	}
+	return tdef, nil
 }
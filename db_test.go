@@ -1,15 +1,20 @@
 package tinydb
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
-const DB_PATH = "archive/testdb"
 const TABLE_NAME = "test"
 
 func TestDB(t *testing.T) {
-	db, err := Open(DB_PATH)
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -234,3 +239,615 @@ func TestDB(t *testing.T) {
 	require.True(t, got, "delete success")
 
 }
+
+func scanIDs(t *testing.T, db *DB, table string, start, end Record, cmp1, cmp2 int) []int64 {
+	sc, err := db.Scan(table, start, end, cmp1, cmp2)
+	require.NoError(t, err)
+
+	var ids []int64
+	for ; sc.Valid(); sc.Next() {
+		rec := Record{}
+		sc.Deref(&rec)
+		ids = append(ids, rec.Get("id").I64)
+	}
+	return ids
+}
+
+func TestDBScan(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.TableNew(&TableDef{
+		Name:  "scan",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	}))
+	// another table with adjacent keys
+	require.NoError(t, db.TableNew(&TableDef{
+		Name:  "other",
+		Types: []uint32{TYPE_INT64},
+		Cols:  []string{"id"},
+		PKeys: 1,
+	}))
+
+	for i := int64(-5); i <= 5; i++ {
+		rec := (&Record{}).AddInt64("id", i).AddStr("name", []byte(fmt.Sprint("n", i)))
+		ok, err := db.Insert("scan", *rec)
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = db.Insert("other", *(&Record{}).AddInt64("id", i))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	key := func(id int64) Record {
+		return *(&Record{}).AddInt64("id", id)
+	}
+
+	require.Equal(t, []int64{-1, 0, 1, 2}, scanIDs(t, db, "scan", key(-1), key(3), CMP_GE, CMP_LT))
+	require.Equal(t, []int64{0, 1, 2, 3}, scanIDs(t, db, "scan", key(-1), key(3), CMP_GT, CMP_LE))
+	require.Equal(t, []int64{3, 2, 1, 0}, scanIDs(t, db, "scan", key(3), key(-1), CMP_LE, CMP_GT))
+	require.Equal(t, []int64{2, 1, 0, -1}, scanIDs(t, db, "scan", key(3), key(-1), CMP_LT, CMP_GE))
+	require.Equal(t, []int64{4, 5}, scanIDs(t, db, "scan", key(3), Record{}, CMP_GT, CMP_LE))
+	require.Equal(t, []int64{-4, -5}, scanIDs(t, db, "scan", key(-3), Record{}, CMP_LT, CMP_GE))
+	require.Empty(t, scanIDs(t, db, "scan", key(5), key(10), CMP_GT, CMP_LT))
+
+	// the whole table
+	ids := scanIDs(t, db, "scan", Record{}, Record{}, CMP_GE, CMP_LE)
+	require.Equal(t, []int64{-5, -4, -3, -2, -1, 0, 1, 2, 3, 4, 5}, ids)
+
+	// the row content
+	sc, err := db.Scan("scan", key(2), key(2), CMP_GE, CMP_LE)
+	require.NoError(t, err)
+	require.True(t, sc.Valid())
+	rec := Record{}
+	sc.Deref(&rec)
+	require.Equal(t, []string{"id", "name"}, rec.Cols)
+	require.Equal(t, []byte("n2"), rec.Get("name").Str)
+	sc.Next()
+	require.False(t, sc.Valid())
+
+	_, err = db.Scan("scan", key(1), key(2), CMP_GE, CMP_GT)
+	require.Error(t, err)
+	_, err = db.Scan("scan", key(1), key(2), 1, CMP_LT)
+	require.Error(t, err)
+	_, err = db.Scan("scan", key(2), key(1), CMP_LE, 4)
+	require.Error(t, err)
+}
+
+func TestDBIndex(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:    "person",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64},
+		Cols:    []string{"id", "name", "age"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}, {"name", "age"}},
+	}
+	require.NoError(t, db.TableNew(tdef))
+	require.Equal(t, uint32(TABLE_PREFIX_MIN), tdef.Prefix)
+	require.Equal(t, []uint32{TABLE_PREFIX_MIN + 1, TABLE_PREFIX_MIN + 2}, tdef.IndexPrefixes)
+	require.Equal(t, [][]string{{"age", "id"}, {"name", "age", "id"}}, tdef.Indexes)
+
+	tdef2 := &TableDef{
+		Name:  "other",
+		Types: []uint32{TYPE_INT64},
+		Cols:  []string{"id"},
+		PKeys: 1,
+	}
+	require.NoError(t, db.TableNew(tdef2))
+	require.Equal(t, uint32(TABLE_PREFIX_MIN+3), tdef2.Prefix)
+
+	bad := &TableDef{
+		Name:    "bad",
+		Types:   []uint32{TYPE_INT64},
+		Cols:    []string{"id"},
+		PKeys:   1,
+		Indexes: [][]string{{"nope"}},
+	}
+	require.Error(t, db.TableNew(bad))
+
+	person := func(id int64, name string, age int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(name)).AddInt64("age", age)
+	}
+	for _, rec := range []Record{
+		person(1, "alice", 30),
+		person(2, "bob", 25),
+		person(3, "carol", 30),
+		person(4, "dave", 40),
+		person(5, "bob", 35),
+	} {
+		ok, err := db.Insert("person", rec)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	age := func(age int64) Record {
+		return *(&Record{}).AddInt64("age", age)
+	}
+	require.Equal(t, []int64{1, 3}, scanIDs(t, db, "person", age(30), age(30), CMP_GE, CMP_LE))
+	require.Equal(t, []int64{1, 3, 5, 4}, scanIDs(t, db, "person", age(30), age(100), CMP_GE, CMP_LE))
+	require.Equal(t, []int64{4, 5, 3, 1, 2}, scanIDs(t, db, "person", age(100), age(0), CMP_LE, CMP_GE))
+
+	name := func(name string) Record {
+		return *(&Record{}).AddStr("name", []byte(name))
+	}
+	require.Equal(t, []int64{2, 5}, scanIDs(t, db, "person", name("bob"), name("bob"), CMP_GE, CMP_LE))
+	nameAge := *(&Record{}).AddStr("name", []byte("bob")).AddInt64("age", 30)
+	require.Equal(t, []int64{5}, scanIDs(t, db, "person", nameAge, name("bob"), CMP_GT, CMP_LE))
+
+	// the index keys follow updates and deletions
+	ok, err := db.Update("person", person(2, "bob", 50))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []int64{5, 4, 2}, scanIDs(t, db, "person", age(30), age(100), CMP_GT, CMP_LE))
+
+	ok, err = db.Delete("person", *(&Record{}).AddInt64("id", 5))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, []int64{2}, scanIDs(t, db, "person", name("bob"), name("bob"), CMP_GE, CMP_LE))
+	require.Equal(t, []int64{4, 2}, scanIDs(t, db, "person", age(30), age(100), CMP_GT, CMP_LE))
+
+	sc, err := db.Scan("person", name("bob"), Record{}, CMP_GE, CMP_LE)
+	require.NoError(t, err)
+	rec := Record{}
+	sc.Deref(&rec)
+	require.Equal(t, person(2, "bob", 50), rec)
+
+	// no index for the columns
+	_, err = db.Scan("person", *(&Record{}).AddInt64("age", 1), name("bob"), CMP_GE, CMP_LE)
+	require.Error(t, err)
+
+	// the index key is too large, the row is not added either
+	_, err = db.Insert("person", person(6, strings.Repeat("x", BTREE_PAGE_MAX_KEY_SIZE), 1))
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+	require.Empty(t, scanIDs(t, db, "person", age(1), age(1), CMP_GE, CMP_LE))
+
+	// a missing index key is reported as corruption
+	ok, err = db.kv.Delete(indexKey(tdef, 0, person(4, "dave", 40).Vals))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = db.Delete("person", *(&Record{}).AddInt64("id", 4))
+	require.ErrorIs(t, err, ErrCorrupted)
+	_, err = db.Update("person", person(4, "dave", 41))
+	require.ErrorIs(t, err, ErrCorrupted)
+
+	// so is a missing row of an index key
+	ok, err = db.kv.Delete(encodeKey(nil, tdef.Prefix, person(2, "bob", 50).Vals[:1]))
+	require.NoError(t, err)
+	require.True(t, ok)
+	sc, err = db.Scan("person", name("bob"), Record{}, CMP_GE, CMP_LE)
+	require.NoError(t, err)
+	defer sc.Close()
+	require.True(t, sc.Valid())
+	require.ErrorIs(t, sc.Deref(&rec), ErrCorrupted)
+}
+
+func TestDBTX(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdb")
+	db, err := Open(path, nil)
+	require.NoError(t, err)
+
+	tdef := func() *TableDef {
+		return &TableDef{
+			Name:    "tx",
+			Types:   []uint32{TYPE_INT64, TYPE_INT64},
+			Cols:    []string{"id", "val"},
+			PKeys:   1,
+			Indexes: [][]string{{"val"}},
+		}
+	}
+	row := func(id, val int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddInt64("val", val)
+	}
+
+	// the aborted table is gone with its rows
+	def := tdef()
+	tx := db.Begin()
+	require.NoError(t, tx.TableNew(def))
+	require.Zero(t, def.Prefix)
+	ok, err := tx.Insert("tx", row(1, 10))
+	require.NoError(t, err)
+	require.True(t, ok)
+	got := *(&Record{}).AddInt64("id", 1)
+	ok, err = tx.Get("tx", &got)
+	require.NoError(t, err)
+	require.True(t, ok)
+	tx.Abort()
+
+	_, err = db.Insert("tx", row(1, 10))
+	require.Error(t, err)
+
+	// the committed operations are persisted together,
+	// the definition can be reused after the abort
+	tx = db.Begin()
+	require.NoError(t, tx.TableNew(def))
+	for i := int64(1); i <= 100; i++ {
+		ok, err = tx.Insert("tx", row(i, i*10))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+	ok, err = tx.Delete("tx", *(&Record{}).AddInt64("id", 50))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, tx.Commit())
+	db.Close()
+
+	db, err = Open(path, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := func(v int64) Record {
+		return *(&Record{}).AddInt64("val", v)
+	}
+	ids := scanIDs(t, db, "tx", val(480), val(520), CMP_GE, CMP_LE)
+	require.Equal(t, []int64{48, 49, 51, 52}, ids)
+}
+
+func TestDBConcurrent(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.TableNew(&TableDef{
+		Name:    "counter",
+		Types:   []uint32{TYPE_INT64, TYPE_INT64},
+		Cols:    []string{"id", "val"},
+		PKeys:   1,
+		Indexes: [][]string{{"val"}},
+	}))
+
+	var wg sync.WaitGroup
+	for w := int64(0); w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int64(0); i < 10; i++ {
+				_, err := db.Insert("counter", *(&Record{}).AddInt64("id", w*100+i).AddInt64("val", i))
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val := func(v int64) Record {
+		return *(&Record{}).AddInt64("val", v)
+	}
+	require.Equal(t, []int64{3, 103, 203, 303}, scanIDs(t, db, "counter", val(3), val(3), CMP_GE, CMP_LE))
+	require.Len(t, scanIDs(t, db, "counter", Record{}, Record{}, CMP_GE, CMP_LE), 40)
+
+	// the tables created concurrently are retried on conflicts
+	tdefs := make([]*TableDef, 8)
+	start := make(chan struct{})
+	for w := range tdefs {
+		tdefs[w] = &TableDef{
+			Name:    fmt.Sprintf("t%d", w),
+			Types:   []uint32{TYPE_INT64, TYPE_INT64},
+			Cols:    []string{"id", "val"},
+			PKeys:   1,
+			Indexes: [][]string{{"val"}},
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := db.TableNew(tdefs[w]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	prefixes := map[uint32]bool{}
+	for _, tdef := range tdefs {
+		prefixes[tdef.Prefix] = true
+		prefixes[tdef.IndexPrefixes[0]] = true
+	}
+	require.Len(t, prefixes, 2*len(tdefs))
+}
+
+func TestDBBlob(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:  "files",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BLOB},
+		Cols:  []string{"id", "name", "data"},
+		PKeys: 1,
+	}
+	require.NoError(t, db.TableNew(tdef))
+	require.Error(t, db.TableNew(&TableDef{
+		Name: "bad", Types: []uint32{TYPE_BLOB}, Cols: []string{"id"}, PKeys: 1,
+	}))
+
+	readBlob := func(id int64) []byte {
+		b, err := db.OpenBlob("files", *(&Record{}).AddInt64("id", id), "data")
+		require.NoError(t, err)
+		defer b.Close()
+		data, err := io.ReadAll(b)
+		require.NoError(t, err)
+		return data
+	}
+
+	data := []byte(strings.Repeat("0123456789", 1000))
+	file := func(id int64, name string, data []byte) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(name)).AddBlob("data", data)
+	}
+	ok, err := db.Insert("files", file(1, "a.txt", data))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, data, readBlob(1))
+
+	// the row stores a reference
+	rec := (&Record{}).AddInt64("id", 1)
+	ok, err = db.Get("files", rec)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Nil(t, rec.Get("data").Str)
+
+	// nil keeps the blob
+	ok, err = db.Update("files", file(1, "b.txt", nil))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, data, readBlob(1))
+
+	// streaming
+	w, err := db.CreateBlob("files", *(&Record{}).AddInt64("id", 2), "data")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err = w.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	_, err = db.Insert("files", file(2, "c.txt", nil))
+	require.NoError(t, err)
+	require.Equal(t, []byte(strings.Repeat(string(data), 10)), readBlob(2))
+
+	// the blob is removed with the row
+	ok, err = db.Delete("files", *(&Record{}).AddInt64("id", 1))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = db.OpenBlob("files", *(&Record{}).AddInt64("id", 1), "data")
+	require.ErrorIs(t, err, ErrNotFound)
+	_, err = db.OpenBlob("files", *(&Record{}).AddInt64("id", 2), "name")
+	require.Error(t, err)
+}
+
+func TestDBReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testdb")
+
+	// a missing file is not created
+	_, err := Open(path, &Options{ReadOnly: true})
+	require.Error(t, err)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	db, err := Open(path, nil)
+	require.NoError(t, err)
+	tdef := &TableDef{
+		Name:  "users",
+		Types: []uint32{TYPE_INT64, TYPE_BYTES},
+		Cols:  []string{"id", "name"},
+		PKeys: 1,
+	}
+	require.NoError(t, db.TableNew(tdef))
+	user := func(id int64, name string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(name))
+	}
+	for i := int64(1); i <= 10; i++ {
+		_, err := db.Insert("users", user(i, fmt.Sprint("user", i)))
+		require.NoError(t, err)
+	}
+	db.Close()
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	// the readers share the file with each other and with a writer
+	db, err = Open(path, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	writer, err := Open(path, nil)
+	require.NoError(t, err)
+	other, err := Open(path, &Options{ReadOnly: true})
+	require.NoError(t, err)
+	other.Close()
+	writer.Close()
+
+	rec := (&Record{}).AddInt64("id", 3)
+	ok, err := db.Get("users", rec)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "user3", string(rec.Get("name").Str))
+	id := func(id int64) Record { return *(&Record{}).AddInt64("id", id) }
+	require.Len(t, scanIDs(t, db, "users", id(1), id(10), CMP_GE, CMP_LE), 10)
+
+	_, err = db.Insert("users", user(11, "user11"))
+	require.ErrorIs(t, err, ErrReadOnly)
+	_, err = db.Delete("users", id(1))
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, db.TableNew(&TableDef{
+		Name: "other", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1,
+	}), ErrReadOnly)
+	db.Close()
+
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestDBBulkInsert(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:    "person",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_INT64, TYPE_BLOB},
+		Cols:    []string{"id", "name", "age", "photo"},
+		PKeys:   1,
+		Indexes: [][]string{{"age"}},
+	}
+	require.NoError(t, db.TableNew(tdef))
+	person := func(id int64, age int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("p", id))).
+			AddInt64("age", age).AddBlob("photo", []byte(strings.Repeat("x", int(id))))
+	}
+	_, err = db.Insert("person", person(0, 20))
+	require.NoError(t, err)
+
+	// in any order
+	var rows []Record
+	for id := int64(1000); id > 0; id-- {
+		rows = append(rows, person(id, 20+id%50))
+	}
+	require.NoError(t, db.BulkInsert("person", rows))
+
+	rec := (&Record{}).AddInt64("id", 123)
+	ok, err := db.Get("person", rec)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "p123", string(rec.Get("name").Str))
+	b, err := db.OpenBlob("person", *(&Record{}).AddInt64("id", 123), "photo")
+	require.NoError(t, err)
+	photo, err := io.ReadAll(b)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+	require.Equal(t, strings.Repeat("x", 123), string(photo))
+
+	age := func(age int64) Record {
+		return *(&Record{}).AddInt64("age", age)
+	}
+	ids := scanIDs(t, db, "person", age(20), age(20), CMP_GE, CMP_LE)
+	require.Len(t, ids, 21)
+	require.Equal(t, int64(0), ids[0])
+
+	// the rows must be new
+	require.Error(t, db.BulkInsert("person", []Record{person(2000, 1), person(5, 1)}))
+	require.Error(t, db.BulkInsert("person", []Record{person(2000, 1), person(2000, 1)}))
+	require.Empty(t, scanIDs(t, db, "person", age(1), age(1), CMP_GE, CMP_LE))
+}
+
+func TestDBBackupTo(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tdef := &TableDef{
+		Name:    "users",
+		Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BLOB},
+		Cols:    []string{"id", "name", "avatar"},
+		PKeys:   1,
+		Indexes: [][]string{{"name"}},
+	}
+	require.NoError(t, db.TableNew(tdef))
+	user := func(id int64) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("user", id))).
+			AddBlob("avatar", []byte(strings.Repeat("a", int(id)*100)))
+	}
+	for i := int64(1); i <= 100; i++ {
+		_, err := db.Insert("users", user(i))
+		require.NoError(t, err)
+	}
+
+	path := filepath.Join(dir, "backup")
+	require.NoError(t, db.BackupTo(path))
+	_, err = db.Delete("users", *(&Record{}).AddInt64("id", 7))
+	require.NoError(t, err)
+
+	copied, err := Open(path, nil)
+	require.NoError(t, err)
+	defer copied.Close()
+	rec := (&Record{}).AddInt64("id", 7)
+	ok, err := copied.Get("users", rec)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "user7", string(rec.Get("name").Str))
+	b, err := copied.OpenBlob("users", *(&Record{}).AddInt64("id", 7), "avatar")
+	require.NoError(t, err)
+	avatar, err := io.ReadAll(b)
+	require.NoError(t, err)
+	require.NoError(t, b.Close())
+	require.Equal(t, strings.Repeat("a", 700), string(avatar))
+
+	name := func(name string) Record {
+		return *(&Record{}).AddStr("name", []byte(name))
+	}
+	require.Len(t, scanIDs(t, copied, "users", name("user1"), name("user2"), CMP_GE, CMP_LT), 12)
+
+	// the live files are not overwritten
+	require.Error(t, db.BackupTo(filepath.Join(dir, "testdb")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "testdb"), filepath.Join(dir, "link")))
+	require.Error(t, db.BackupTo(filepath.Join(dir, "link")))
+	ok, err = db.Get("users", (&Record{}).AddInt64("id", 8))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	logged, err := Open(filepath.Join(dir, "logged"), &Options{WAL: true})
+	require.NoError(t, err)
+	require.NoError(t, logged.TableNew(&TableDef{Name: "t", Types: []uint32{TYPE_INT64}, Cols: []string{"id"}, PKeys: 1}))
+	require.Error(t, logged.BackupTo(walPath(filepath.Join(dir, "logged"))))
+	logged.Close()
+	logged, err = Open(filepath.Join(dir, "logged"), &Options{WAL: true})
+	require.NoError(t, err)
+	defer logged.Close()
+	_, err = logged.Insert("t", *(&Record{}).AddInt64("id", 1))
+	require.NoError(t, err)
+}
+
+func TestDBTableStats(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "testdb"), nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	for _, name := range []string{"a", "b"} {
+		require.NoError(t, db.TableNew(&TableDef{
+			Name:    name,
+			Types:   []uint32{TYPE_INT64, TYPE_BYTES, TYPE_BLOB},
+			Cols:    []string{"id", "name", "data"},
+			PKeys:   1,
+			Indexes: [][]string{{"name"}},
+		}))
+	}
+	row := func(id int64, data string) Record {
+		return *(&Record{}).AddInt64("id", id).AddStr("name", []byte(fmt.Sprint("n", id))).
+			AddBlob("data", []byte(data))
+	}
+	for i := int64(0); i < 100; i++ {
+		_, err := db.Insert("a", row(i, strings.Repeat("x", 10000)))
+		require.NoError(t, err)
+	}
+	for i := int64(0); i < 10; i++ {
+		_, err := db.Insert("b", row(i, "y"))
+		require.NoError(t, err)
+	}
+
+	a, err := db.TableStats("a")
+	require.NoError(t, err)
+	require.Equal(t, 100, a.Rows)
+	require.Greater(t, a.RowBytes, int64(0))
+	require.Greater(t, a.IndexBytes, int64(0))
+	require.Greater(t, a.BlobBytes, int64(100*10000))
+	b, err := db.TableStats("b")
+	require.NoError(t, err)
+	require.Equal(t, 10, b.Rows)
+	require.Less(t, b.BlobBytes, int64(10000))
+
+	_, err = db.Delete("a", *(&Record{}).AddInt64("id", 0))
+	require.NoError(t, err)
+	a2, err := db.TableStats("a")
+	require.NoError(t, err)
+	require.Equal(t, 99, a2.Rows)
+	require.Less(t, a2.BlobBytes, a.BlobBytes)
+
+	_, err = db.TableStats("c")
+	require.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package tinydb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// DBTX a transaction of the table layer, all the operations
+// are committed or rolled back as one unit, see KVTX.
+type DBTX struct {
+	db *DB
+	kv *KVTX
+	// table definitions read by this transaction,
+	// they are cached in the DB after the commit.
+	tables map[string]*TableDef
+}
+
+// Begin start a transaction
+func (db *DB) Begin() *DBTX {
+	return &DBTX{
+		db:     db,
+		kv:     db.kv.Begin(),
+		tables: make(map[string]*TableDef),
+	}
+}
+
+// Commit persist the updates
+func (tx *DBTX) Commit() error {
+	if err := tx.kv.Commit(); err != nil {
+		return err
+	}
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.db.tables == nil {
+		tx.db.tables = make(map[string]*TableDef)
+	}
+	maps.Copy(tx.db.tables, tx.tables)
+	return nil
+}
+
+// Abort discard the updates, it's a no-op after the commit
+func (tx *DBTX) Abort() {
+	tx.kv.Abort()
+}
+
+// TableNew create a new table.
+// the definition is not modified, the prefixes are assigned to a copy.
+func (tx *DBTX) TableNew(tdef *TableDef) error {
+	_, err := tableNew(tx, tdef)
+	return err
+}
+
+// create a table from a copy of the definition and return the copy,
+// so that the definition can be reused after an abort or a conflict.
+func tableNew(tx *DBTX, def *TableDef) (*TableDef, error) {
+	if tx.db.kv.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	tdef := *def
+	tdef.Indexes = slices.Clone(def.Indexes)
+	if err := tableDefCheck(&tdef); err != nil {
+		return nil, err
+	}
+	// check the existing table
+	table := (&Record{}).AddStr("name", []byte(tdef.Name))
+	ok, err := dbGet(tx, TDEF_TABLE, table)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, fmt.Errorf("table exists: %s", tdef.Name)
+	}
+	// allocate new prefixes for the table and its indexes
+	tdef.Prefix = TABLE_PREFIX_MIN
+	meta := (&Record{}).AddStr("key", []byte("next_prefix"))
+	ok, err = dbGet(tx, TDEF_META, meta)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		tdef.Prefix = binary.LittleEndian.Uint32(meta.Get("val").Str)
+		if tdef.Prefix <= TABLE_PREFIX_MIN {
+			return nil, fmt.Errorf("%w: bad next prefix %d", ErrCorrupted, tdef.Prefix)
+		}
+	} else {
+		meta.AddStr("val", make([]byte, 4))
+	}
+	tdef.IndexPrefixes = nil
+	for i := range tdef.Indexes {
+		tdef.IndexPrefixes = append(tdef.IndexPrefixes, tdef.Prefix+1+uint32(i))
+	}
+	// update the next prefix
+	next := tdef.Prefix + 1 + uint32(len(tdef.Indexes))
+	binary.LittleEndian.PutUint32(meta.Get("val").Str, next)
+	_, err = dbUpdate(tx, TDEF_META, *meta, MODE_UPSERT)
+	if err != nil {
+		return nil, err
+	}
+
+	// store the definition
+	val, err := json.Marshal(&tdef)
+	assert(err == nil, "error never happened")
+	table.AddStr("def", val)
+	if _, err = dbUpdate(tx, TDEF_TABLE, *table, MODE_UPSERT); err != nil {
+		return nil, err
+	}
+	return &tdef, nil
+}
+
+// Get get a single row by the primary key
+func (tx *DBTX) Get(table string, rec *Record) (bool, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return dbGet(tx, tdef, rec)
+}
+
+// Scan range query on the primary key or an index, see Scanner.
+// the scanner is only valid within the transaction.
+func (tx *DBTX) Scan(table string, start, end Record, cmp1, cmp2 int) (*Scanner, error) {
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &Scanner{Cmp1: cmp1, Cmp2: cmp2, Key1: start, Key2: end}
+	if err := dbScan(tx, tdef, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Set add a record
+func (tx *DBTX) Set(table string, rec Record, mode UpdateMode) (bool, error) {
+	if tx.db.kv.ReadOnly {
+		return false, ErrReadOnly
+	}
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return dbUpdate(tx, tdef, rec, mode)
+}
+
+func (tx *DBTX) Insert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_INSERT_ONLY)
+}
+
+func (tx *DBTX) Update(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPDATE_ONLY)
+}
+
+func (tx *DBTX) Upsert(table string, rec Record) (bool, error) {
+	return tx.Set(table, rec, MODE_UPSERT)
+}
+
+func (tx *DBTX) Delete(table string, rec Record) (bool, error) {
+	if tx.db.kv.ReadOnly {
+		return false, ErrReadOnly
+	}
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return false, err
+	}
+	return dbDelete(tx, tdef, rec)
+}
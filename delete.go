@@ -1,11 +1,28 @@
 package tinydb
 
 // delete a record by its primary key
-func dbDelete(db *DB, tdef *TableDef, rec Record) (bool, error) {
+func dbDelete(tx *DBTX, tdef *TableDef, rec Record) (bool, error) {
 	values, err := checkRecord(tdef, rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	return db.kv.Delete(key)
+
+	// the old row is needed to remove its index keys
+	old, exists, err := tx.kv.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	// the row and its index keys are updated in a single transaction
+	if len(tdef.Indexes) > 0 {
+		err := indexOp(tx.kv, tdef, decodeRow(tdef, values[:tdef.PKeys], old), INDEX_DEL)
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := blobDelete(tx, tdef, values); err != nil {
+		return false, err
+	}
+	return tx.kv.Delete(key)
 }
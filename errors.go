@@ -0,0 +1,51 @@
+package tinydb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrConflict the transaction conflicts with a concurrent one, it can be retried
+var ErrConflict = errors.New("tinydb: transaction conflict")
+
+// errors of the storage engine, the bad pages are reported with PageError
+var (
+	ErrEmptyKey      = errors.New("tinydb: empty key")
+	ErrKeyTooLarge   = errors.New("tinydb: key too large")
+	ErrValueTooLarge = errors.New("tinydb: value too large")
+	ErrBadPointer    = errors.New("tinydb: bad page pointer")
+	ErrCorrupted     = errors.New("tinydb: data corrupted")
+	ErrLeaked        = errors.New("tinydb: pages leaked")
+	ErrNotFound      = errors.New("tinydb: key not found")
+	ErrPageSize      = errors.New("tinydb: page size mismatch")
+	ErrReadOnly      = errors.New("tinydb: read-only database")
+	ErrLocked        = errors.New("tinydb: database is locked")
+	ErrUnsorted      = errors.New("tinydb: unsorted bulk load input")
+)
+
+// PageError an error of a specific page
+type PageError struct {
+	Page uint64 // the page number
+	Err  error
+}
+
+func (e *PageError) Error() string {
+	return fmt.Sprintf("%v: page %d", e.Err, e.Page)
+}
+
+func (e *PageError) Unwrap() error {
+	return e.Err
+}
+
+// the page callbacks of the B-tree and the free list can't return errors,
+// they panic with the error of a bad page instead, which is converted back
+// to an error at the API boundary by deferring this function.
+func recoverPageError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(error)
+		if !ok || !(errors.Is(e, ErrCorrupted) || errors.Is(e, ErrBadPointer)) {
+			panic(r)
+		}
+		*err = e
+	}
+}
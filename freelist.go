@@ -5,7 +5,6 @@ import "encoding/binary"
 const (
 	BNODE_FREE_LIST  = 3
 	FREE_LIST_HEADER = 4 + 8 + 8 // type(2B) + size(2B) + total(8B) + next(8B)
-	FREE_LIST_CAP    = (BTREE_PAGE_SIZE - FREE_LIST_HEADER) >> 3
 )
 
 // Freelist The node format:
@@ -15,7 +14,8 @@ const (
 // the link to the next node
 // the total number of items in the list, only applied to the head node
 type Freelist struct {
-	head uint64
+	head     uint64
+	pageSize int
 	// callbacks for managing on-disk pages
 	get func(uint64) BNode      // dereference a pointer
 	new func(node BNode) uint64 // append a new page
@@ -27,6 +27,11 @@ func (fl *Freelist) Total() uint64 {
 	return binary.LittleEndian.Uint64(fl.get(fl.head).data[HEADER:])
 }
 
+// the number of pointers in a node
+func (fl *Freelist) cap() int {
+	return (nodeSize(fl.pageSize) - FREE_LIST_HEADER) >> 3
+}
+
 // Get return the nth pointer
 func (fl *Freelist) Get(topn int) uint64 {
 	assert(0 <= topn && uint64(topn) < fl.Total(), "bad topn!")
@@ -54,7 +59,12 @@ func (fl *Freelist) Update(popn int, freed []uint64) {
 	total := fl.Total()
 	var reuse []uint64
 
-	for fl.head != 0 && len(reuse)*FREE_LIST_CAP < len(freed) {
+	// pop until the `popn` pointers are removed
+	// and there are enough pages to house the `freed` pointers.
+	// the nodes are popped for `popn` regardless of `freed`, so a pointer
+	// taken for a node can leave the others fitting in fewer nodes,
+	// the surplus pages are pushed as empty nodes, see flPush.
+	for fl.head != 0 && (popn > 0 || len(reuse)*fl.cap() < len(freed)) {
 		node := fl.get(fl.head)
 		freed = append(freed, fl.head) // recycle the node itself
 
@@ -69,7 +79,7 @@ func (fl *Freelist) Update(popn int, freed []uint64) {
 			popn = 0
 			// reuse pointers from the free list itself
 
-			for remain > 0 && len(reuse)*FREE_LIST_CAP < len(freed)+remain {
+			for remain > 0 && len(reuse)*fl.cap() < len(freed)+remain {
 				remain--
 				reuse = append(reuse, flnPtr(node, remain))
 			}
@@ -85,7 +95,7 @@ func (fl *Freelist) Update(popn int, freed []uint64) {
 		fl.head = flnNext(node)
 	}
 
-	assert(len(reuse)*FREE_LIST_CAP >= len(freed) || fl.head == 0, "pop error")
+	assert(len(reuse)*fl.cap() >= len(freed) || fl.head == 0, "pop error")
 
 	// phase3: prepend new nodes
 	flPush(fl, freed, reuse)
@@ -95,13 +105,14 @@ func (fl *Freelist) Update(popn int, freed []uint64) {
 }
 
 func flPush(fl *Freelist, freed, reuse []uint64) {
-	for len(freed) > 0 {
-		newNode := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+	// every reused page is a node, it can be empty
+	for len(freed) > 0 || len(reuse) > 0 {
+		newNode := NewBNode(make([]byte, fl.pageSize))
 
 		// construct a new node
 		size := len(freed)
-		if size > FREE_LIST_CAP {
-			size = FREE_LIST_CAP
+		if size > fl.cap() {
+			size = fl.cap()
 		}
 		flnSetHeader(newNode, uint16(size), fl.head)
 
@@ -120,8 +131,6 @@ func flPush(fl *Freelist, freed, reuse []uint64) {
 			fl.head = fl.new(newNode)
 		}
 	}
-
-	assert(len(reuse) == 0, "reuse must empty!")
 }
 
 func flnSize(node BNode) int {
@@ -0,0 +1,114 @@
+package tinydb
+
+import (
+	"fmt"
+	"slices"
+)
+
+// modes of the index maintenance
+const (
+	INDEX_ADD = 1
+	INDEX_DEL = 2
+)
+
+// normalize the secondary indexes and check them against the columns
+func indexDefCheck(tdef *TableDef) error {
+	for i, index := range tdef.Indexes {
+		if len(index) == 0 {
+			return fmt.Errorf("tinydb: empty index")
+		}
+		for _, col := range index {
+			idx := slices.Index(tdef.Cols, col)
+			if idx < 0 || tdef.Types[idx] == TYPE_BLOB {
+				return fmt.Errorf("tinydb: bad index column: %s", col)
+			}
+		}
+		// append the primary key so that the index keys are unique
+		index = slices.Clone(index)
+		for _, col := range tdef.Cols[:tdef.PKeys] {
+			if !slices.Contains(index, col) {
+				index = append(index, col)
+			}
+		}
+		tdef.Indexes[i] = index
+	}
+	return nil
+}
+
+// the columns of an index, -1 denotes the primary key
+func indexCols(tdef *TableDef, index int) []string {
+	if index < 0 {
+		return tdef.Cols[:tdef.PKeys]
+	}
+	return tdef.Indexes[index]
+}
+
+// find an index whose leading columns are the given columns.
+// returns -1 for the primary key and -2 if there is none.
+func findIndex(tdef *TableDef, cols ...[]string) int {
+	for index := -1; index < len(tdef.Indexes); index++ {
+		icols := indexCols(tdef, index)
+		ok := true
+		for _, c := range cols {
+			ok = ok && len(c) <= len(icols) && slices.Equal(icols[:len(c)], c)
+		}
+		if ok {
+			return index
+		}
+	}
+	return -2
+}
+
+// check and order the values of an index key prefix
+func checkIndexKey(tdef *TableDef, index int, rec Record) ([]Value, error) {
+	icols := indexCols(tdef, index)
+	if len(rec.Cols) > len(icols) {
+		return nil, fmt.Errorf("tinydb: too many columns for the index")
+	}
+	values := make([]Value, len(rec.Cols))
+	for i, col := range rec.Cols {
+		if col != icols[i] {
+			return nil, fmt.Errorf("tinydb: invalid column name: %s", col)
+		}
+		typ := tdef.Types[slices.Index(tdef.Cols, col)]
+		if rec.Vals[i].Type != typ {
+			return nil, fmt.Errorf("tinydb: invalid column type: %s", col)
+		}
+		values[i] = rec.Vals[i]
+	}
+	return values, nil
+}
+
+// add or remove the index keys of a row.
+// `values` are all the columns of the row in the table order.
+func indexOp(tx *KVTX, tdef *TableDef, values []Value, op int) error {
+	for i := range tdef.Indexes {
+		key := indexKey(tdef, i, values)
+		switch op {
+		case INDEX_ADD:
+			if err := tx.Set(key, nil); err != nil {
+				return err
+			}
+		case INDEX_DEL:
+			deleted, err := tx.Delete(key)
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				return fmt.Errorf("%w: table %s: missing key of the index %v", ErrCorrupted, tdef.Name, tdef.Indexes[i])
+			}
+		default:
+			panic("bad index op")
+		}
+	}
+	return nil
+}
+
+// the key of a row in an index
+func indexKey(tdef *TableDef, index int, values []Value) []byte {
+	ivals := make([]Value, len(tdef.Indexes[index]))
+	for j, col := range tdef.Indexes[index] {
+		ivals[j] = values[slices.Index(tdef.Cols, col)]
+	}
+	return encodeKey(nil, tdef.IndexPrefixes[index], ivals)
+}
@@ -1,14 +1,21 @@
 package tinydb
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
+	"slices"
+	"sync"
 	"syscall"
+	"time"
 )
 
 type KV struct {
 	Path string
+	Options
 	// internals
 	fp   *os.File
 	tree BTree
@@ -19,17 +26,56 @@ type KV struct {
 		chunks [][]byte // multiple mmaps, can be non-continues
 	}
 	page struct {
-		flushed uint64 // database size in number of pages
-		nfree   int    // number of pages taken from the free list
-		nappend int    // number of pages to be appended
+		flushed  uint64 // database size in number of pages
+		nfree    int    // number of pages taken from the free list
+		nappend  int    // number of pages to be appended
+		reserved int    // number of pages reserved by the unfinished BlobWriters
+		leaked   bool   // the leaked pages are not reclaimed, see reclaimPages
 		// newly allocated or deallocated pages keyed by the pointer
 		// nil value denotes a deallocated page
 		updates map[uint64][]byte
 	}
+	master struct {
+		seq   uint64 // the number of master page updates, see masterStore
+		clean bool   // the master page is marked by masterClose
+	}
+	// the lock file shared by the read-only opens, see lockReaders
+	lock struct {
+		fp   *os.File
+		held bool // the writer excludes the readers of other processes
+	}
+	// the write-ahead log, see wal.go
+	wal struct {
+		fp   *os.File
+		size int64
+	}
+	// the commits waiting for a shared fsync, see SYNC_GROUP
+	group struct {
+		mu     sync.Mutex
+		cond   *sync.Cond // signaled when a sync is done
+		synced uint64     // the last durable version
+		leader bool       // a committer is syncing for the others
+		err    error      // the failed sync, the later commits fail too
+	}
+	// concurrency control
+	writer  sync.Mutex // serializes the write transactions
+	mu      sync.Mutex // protects the states for readers below
+	version uint64     // the number of commits since opened
+	root    uint64     // the root of the last committed version
+	readers map[*KVReader]struct{}
+	// pages freed by committed versions, they are not reused
+	// until no reader can see them.
+	pinned []pinnedPages
+	// recently committed transactions, for detecting conflicts
+	history []committedTX
 }
 
-func NewDB(path string) (*KV, error) {
+// NewDB open or create a database file, nil options for the defaults
+func NewDB(path string, opts *Options) (*KV, error) {
 	db := &KV{Path: path}
+	if opts != nil {
+		db.Options = *opts
+	}
 	err := db.Open()
 	if err != nil {
 		return nil, err
@@ -38,8 +84,16 @@ func NewDB(path string) (*KV, error) {
 }
 
 func (db *KV) Open() error {
+	if err := optionsCheck(&db.Options); err != nil {
+		return err
+	}
+
 	// open or create the DB file
-	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	flag, prot := os.O_RDWR|os.O_CREATE, syscall.PROT_READ|syscall.PROT_WRITE
+	if db.ReadOnly {
+		flag, prot = os.O_RDONLY, syscall.PROT_READ
+	}
+	fp, err := os.OpenFile(db.Path, flag, db.FileMode)
 	if err != nil {
 		return fmt.Errorf("open file %s: %w", db.Path, err)
 	}
@@ -49,12 +103,25 @@ func (db *KV) Open() error {
 
 	defer func(hasError *int32) {
 		if *hasError != 0 {
-			db.Close()
+			closeFiles(db)
 		}
 	}(&hasErr)
 
+	// only 1 process can write the file, the read-only opens don't
+	// take this lock, they share the lock file instead, see lockReaders.
+	if !db.ReadOnly {
+		if err := fileLock(fp, syscall.LOCK_EX, db.LockTimeout); err != nil {
+			hasErr = int32(1)
+			return fmt.Errorf("lock file %s: %w", db.Path, err)
+		}
+	}
+	if err := lockOpen(db); err != nil {
+		hasErr = int32(1)
+		return fmt.Errorf("open lock file: %w", err)
+	}
+
 	// create the initial mmap
-	sz, chunk, err := mmapInit(fp)
+	sz, chunk, err := mmapInit(fp, db.MmapSize, db.MaxMmapSize, prot)
 	if err != nil {
 		hasErr = int32(1)
 		return fmt.Errorf("mmap init: %w", err)
@@ -82,57 +149,254 @@ func (db *KV) Open() error {
 		hasErr = int32(1)
 		return fmt.Errorf("load master page: %w", err)
 	}
-
-	if db.free.head == 0 && len(db.page.updates) == 0 {
-		node := NewBNode(make([]byte, BTREE_PAGE_SIZE))
+	db.root = db.tree.root
+	clean := db.master.clean
+	db.tree.pageSize = db.PageSize
+	db.free.pageSize = db.PageSize
+	db.readers = make(map[*KVReader]struct{})
+	db.group.cond = sync.NewCond(&db.group.mu)
+
+	fresh := db.free.head == 0
+	if fresh && !db.ReadOnly {
+		// a new file, create the free list.
+		// the pending pages are always flushed between transactions.
+		node := NewBNode(make([]byte, db.PageSize))
 		db.free.head = db.free.new(node)
 		db.pageUse(db.free.head, node)
+		if err := flushPages(db); err != nil {
+			hasErr = int32(1)
+			return err
+		}
 	}
 
+	// recover the commits in the log
+	if err := walOpen(db, fresh); err != nil {
+		hasErr = int32(1)
+		return fmt.Errorf("open log: %w", err)
+	}
+	if !fresh && !clean && !db.ReadOnly {
+		if err := reclaimPages(db); err != nil {
+			hasErr = int32(1)
+			return fmt.Errorf("reclaim pages: %w", err)
+		}
+	}
 	return nil
 }
 
+// the pages pinned by the last commits are not in the free list of the
+// master page, they are leaked if the file is not closed, so are the
+// pages reserved by BlobWriter. the unreachable pages are found by a
+// walk of the B-tree and the free list, and added to the free list.
+// the walk is skipped if the file was closed cleanly, see masterClose.
+func reclaimPages(db *KV) error {
+	v := verifyPages(db)
+	if len(v.errs) > 0 {
+		// the pages can't be freed by a broken walk, see KV.Verify
+		db.Logger.Printf("tinydb: %s: the leaked pages are not reclaimed: %v", db.Path, errors.Join(v.errs...))
+		db.page.leaked = true
+		return nil
+	}
+	var leaked []uint64
+	for ptr, owner := range v.owners {
+		if owner == PAGE_UNUSED {
+			leaked = append(leaked, uint64(ptr))
+		}
+	}
+	if len(leaked) == 0 {
+		return nil
+	}
+	if !lockReaders(db) {
+		// they can be visible to the readers, see lockReaders
+		db.Logger.Printf("tinydb: %s: the leaked pages are not reclaimed while the file is read by others", db.Path)
+		db.page.leaked = true
+		return nil
+	}
+	// not visible to any reader, they are released by the flush
+	db.pinned = append(db.pinned, pinnedPages{version: db.version, ptrs: leaked})
+	return flushPages(db)
+}
+
 // Get read the db by the key
-func (db *KV) Get(key []byte) ([]byte, bool) {
-	return db.tree.Get(key)
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	r := db.BeginRead()
+	defer r.EndRead()
+	val, ok, err := r.Get(key)
+	// the page can be reused after the reader is done
+	return bytes.Clone(val), ok, err
+}
+
+// Seek return an iterator at the first key that is greater or equal to the key.
+// it reads a snapshot like BeginRead, it must be closed when done.
+func (db *KV) Seek(key []byte) *ReadIter {
+	r := db.BeginRead()
+	return &ReadIter{BIter: r.Seek(key), r: r}
+}
+
+// SeekLE return an iterator at the last key that is less or equal to the key.
+// it reads a snapshot like BeginRead, it must be closed when done.
+func (db *KV) SeekLE(key []byte) *ReadIter {
+	r := db.BeginRead()
+	return &ReadIter{BIter: r.SeekLE(key), r: r}
 }
 
 // Set update the k-v to the db
 func (db *KV) Set(key []byte, value []byte) error {
-	db.tree.Insert(key, value)
-	return flushPages(db)
+	tx := db.Begin()
+	if err := tx.Set(key, value); err != nil {
+		tx.Abort()
+		return err
+	}
+	return tx.Commit() // never conflicts without reads
 }
 
 // Delete remove the key to the db
 func (db *KV) Delete(key []byte) (bool, error) {
-	deleted := db.tree.Delete(key)
-	return deleted, flushPages(db)
+	for {
+		tx := db.Begin()
+		deleted, err := tx.Delete(key)
+		if err != nil {
+			tx.Abort()
+			return false, err
+		}
+		err = tx.Commit()
+		if !errors.Is(err, ErrConflict) {
+			return deleted, err
+		}
+	}
 }
 
+// Close the db, all transactions must be done before closing.
 func (db *KV) Close() {
+	db.writer.Lock()
+	var err error
+	if db.deferred() && !db.ReadOnly {
+		// the commits since the last checkpoint
+		err = checkpoint(db)
+	} else if len(db.pinned) > 0 && !db.ReadOnly {
+		// return the pinned pages to the free list
+		err = flushPages(db)
+	}
+	if err == nil && !db.ReadOnly {
+		err = masterClose(db)
+	}
+	if err != nil {
+		db.Logger.Printf("tinydb: close %s: %v", db.Path, err)
+	}
+	db.writer.Unlock()
+	closeFiles(db)
+}
+
+// unmap and close the files without flushing
+func closeFiles(db *KV) {
 	for _, chunk := range db.mmap.chunks {
-		_ = syscall.Munmap(chunk)
+		if err := syscall.Munmap(chunk); err != nil {
+			db.Logger.Printf("tinydb: close %s: munmap: %v", db.Path, err)
+		}
+	}
+	if db.wal.fp != nil {
+		_ = db.wal.fp.Close()
+	}
+	if db.lock.fp != nil {
+		_ = db.lock.fp.Close()
+	}
+	_ = db.fp.Close() // also releases the lock
+}
+
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// the read-only opens hold a shared lock on the lock file until closed.
+// they see the version of the master page when they are opened, so the
+// writer doesn't reuse the freed pages while the lock is shared, and it
+// holds the lock exclusively from reusing them until the master page is
+// updated, so that the readers don't open an older version meanwhile.
+// the lock file is only created by the writer, a read-only open skips
+// it if it's missing, thus it's not protected from a writer opened later.
+func lockOpen(db *KV) error {
+	flag := os.O_RDWR | os.O_CREATE
+	if db.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	fp, err := os.OpenFile(lockPath(db.Path), flag, db.FileMode)
+	if db.ReadOnly && (errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.lock.fp = fp
+	if !db.ReadOnly {
+		return nil
+	}
+	// wait for the writer to update the master page
+	return fileLockWait(fp, syscall.LOCK_SH)
+}
+
+// exclude the readers of other processes until the master page is
+// updated, false if there are such readers, see lockOpen.
+// the pages freed by the writer are not reused unless this is true.
+func lockReaders(db *KV) bool {
+	if db.lock.held || db.lock.fp == nil {
+		return true
+	}
+	err := syscall.Flock(int(db.lock.fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	db.lock.held = err == nil
+	return db.lock.held
+}
+
+func unlockReaders(db *KV) {
+	if db.lock.held {
+		_ = syscall.Flock(int(db.lock.fp.Fd()), syscall.LOCK_UN)
+		db.lock.held = false
+	}
+}
+
+// take the flock, wait for it up to the timeout
+func fileLock(fp *os.File, how int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return ErrLocked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// take the flock, wait for it without a timeout
+func fileLockWait(fp *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(fp.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
 	}
-	_ = db.fp.Close()
 }
 
 // create the initial mmap that covers the whole file.
-func mmapInit(fp *os.File) (int, []byte, error) {
+func mmapInit(fp *os.File, mmapSize int, maxSize int, prot int) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
 	}
-	if fi.Size()%BTREE_PAGE_SIZE != 0 {
+	if fi.Size()%BTREE_PAGE_SIZE_MIN != 0 {
 		return 0, nil, errors.New("file size is not a multiple of page size")
 	}
-	mmapSize := 64 << 20
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
+	if maxSize > 0 && mmapSize > maxSize {
+		return 0, nil, fmt.Errorf("the file is larger than the max mmap size %d", maxSize)
+	}
 	// mmapSize can be larger than the file
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	chunk, err := syscall.Mmap(int(fp.Fd()), 0, mmapSize, prot, syscall.MAP_SHARED)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
@@ -148,21 +412,59 @@ func (db *KV) pageGet(ptr uint64) BNode {
 }
 
 func (db *KV) pageGetMapped(ptr uint64) BNode {
+	if ptr >= db.page.flushed {
+		panic(&PageError{Page: ptr, Err: ErrBadPointer})
+	}
+	return pageVerify(ptr, mmapPage(db.mmap.chunks, ptr, db.PageSize))
+}
+
+func mmapPage(chunks [][]byte, ptr uint64, pageSize int) BNode {
+	if ptr == 0 {
+		panic(&PageError{Page: ptr, Err: ErrBadPointer}) // the master page
+	}
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
-		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk)/pageSize)
 		if ptr < end {
-			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return NewBNode(chunk[offset : offset+BTREE_PAGE_SIZE])
+			offset := uint64(pageSize) * (ptr - start)
+			return NewBNode(chunk[offset : offset+uint64(pageSize)])
 		}
 		start = end
 	}
-	panic("bad ptr")
+	panic(&PageError{Page: ptr, Err: ErrBadPointer})
+}
+
+// a page ends with the crc32 of the rest of the page.
+// the checksum is verified on every read from the mmap,
+// it panics with *PageError, see recoverPageError.
+func pageVerify(ptr uint64, node BNode) BNode {
+	size := nodeSize(len(node.data))
+	sum := binary.LittleEndian.Uint32(node.data[size:])
+	if crc32.ChecksumIEEE(node.data[:size]) != sum {
+		panic(&PageError{Page: ptr, Err: ErrCorrupted})
+	}
+	return node
+}
+
+func pageChecksum(node BNode) {
+	size := nodeSize(len(node.data))
+	sum := crc32.ChecksumIEEE(node.data[:size])
+	binary.LittleEndian.PutUint32(node.data[size:], sum)
+}
+
+// a node larger than the page is rejected before it's written,
+// the transaction fails instead of persisting a corrupted page.
+func pageCheck(node BNode, pageSize int) {
+	assert(len(node.data) <= pageSize, "bad node!")
+	btype := node.btype()
+	if (btype == BNODE_LEAF || btype == BNODE_NODE) && int(node.nbytes()) > nodeSize(pageSize) {
+		panic(fmt.Errorf("%w: a node of %d bytes", ErrCorrupted, node.nbytes()))
+	}
 }
 
 // callback for Btree, allocate a new page
 func (db *KV) pageNew(node BNode) uint64 {
-	assert(len(node.data) <= BTREE_PAGE_SIZE, "bad node!")
+	pageCheck(node, db.PageSize)
 
 	ptr := uint64(0)
 	if uint64(db.page.nfree) < db.free.Total() {
@@ -178,6 +480,31 @@ func (db *KV) pageNew(node BNode) uint64 {
 	return ptr
 }
 
+// reserve a page at the end of the file, the writer lock is held.
+// the page is written directly instead of being a pending update.
+func pageReserve(db *KV) (uint64, error) {
+	assert(db.page.nappend == 0, "pending appended pages!")
+	ptr := db.page.flushed
+	if err := extendFile(db, int(ptr)+1); err != nil {
+		return 0, err
+	}
+	if err := extendMmap(db, int(ptr)+1); err != nil {
+		return 0, err
+	}
+	db.page.flushed++
+	return ptr, nil
+}
+
+// write a reserved page, it's made durable by the next commit
+func pageWrite(db *KV, ptr uint64, node BNode) error {
+	pageChecksum(node)
+	_, err := db.fp.WriteAt(node.data, int64(ptr)*int64(db.PageSize))
+	if err != nil {
+		return fmt.Errorf("write page: %w", err)
+	}
+	return nil
+}
+
 // callback for Btree, deallocate a page
 func (db *KV) pageDel(ptr uint64) {
 	db.page.updates[ptr] = nil
@@ -185,7 +512,7 @@ func (db *KV) pageDel(ptr uint64) {
 
 // callback for FreeList, allocate
 func (db *KV) pageAppend(node BNode) uint64 {
-	assert(len(node.data) <= BTREE_PAGE_SIZE, "bad node!")
+	pageCheck(node, db.PageSize)
 
 	ptr := db.page.flushed + uint64(db.page.nappend)
 	db.page.nappend++
@@ -200,7 +527,7 @@ func (db *KV) pageUse(ptr uint64, node BNode) {
 
 // extend the file to at least `npages`
 func extendFile(db *KV, npages int) error {
-	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	filePages := db.mmap.file / db.PageSize
 	if filePages >= npages {
 		return nil
 	}
@@ -208,14 +535,11 @@ func extendFile(db *KV, npages int) error {
 	for filePages < npages {
 		// the file size is increased exponentially
 		// so what we don't hava to extend the file for every update
-		inc := filePages >> 3
-		if inc < 1 {
-			inc = 1
-		}
+		inc := max(filePages>>3, db.FileGrowth/db.PageSize, 1)
 		filePages += inc
 	}
 
-	fileSize := filePages * BTREE_PAGE_SIZE
+	fileSize := filePages * db.PageSize
 
 	err := fallocate(db.fp, 0, int64(fileSize))
 	if err != nil {
@@ -228,9 +552,12 @@ func extendFile(db *KV, npages int) error {
 
 // extend the mmap by adding new mappings
 func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
+	if db.mmap.total >= npages*db.PageSize {
 		return nil
 	}
+	if db.MaxMmapSize > 0 && 2*db.mmap.total > db.MaxMmapSize {
+		return fmt.Errorf("the database exceeds the max mmap size %d", db.MaxMmapSize)
+	}
 
 	// double the address space
 	chunk, err := syscall.Mmap(int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
@@ -240,7 +567,9 @@ func extendMmap(db *KV, npages int) error {
 	}
 
 	db.mmap.total += db.mmap.total
+	db.mu.Lock() // the chunks are shared with readers
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
+	db.mu.Unlock()
 
 	return nil
 }
@@ -250,30 +579,79 @@ func flushPages(db *KV) error {
 	if err := writePages(db); err != nil {
 		return err
 	}
+	if db.deferred() {
+		resetPages(db)
+		return checkpoint(db)
+	}
 	return syncPages(db)
 }
 
-func syncPages(db *KV) error {
-	// flush db to the disk
-	pageNewCount := uint64(0)
-	for _, page := range db.page.updates {
-		if page != nil {
-			pageNewCount++
-		}
+// the free list and the master page are not updated by every commit
+// in the WAL mode and SYNC_GROUP, they are updated by the checkpoints.
+// the master page can point to an older version until then, so the
+// pages of that version can't be reused, the free list is kept as is
+// while the pages are taken from it, and the freed pages are pinned.
+func (db *KV) deferred() bool {
+	return db.WAL || db.Sync == SYNC_GROUP
+}
+
+// update the free list and the master page to the current version
+func checkpoint(db *KV) error {
+	saved := saveState(db)
+	db.free.Update(db.page.nfree, releasePages(db, nil))
+	db.page.nfree = 0
+	err := copyPages(db)
+	if err == nil {
+		resetPages(db)
+		err = masterSync(db)
+	}
+	if err == nil && db.wal.fp != nil {
+		err = walReset(db)
+	}
+	if err != nil {
+		restoreState(db, saved)
 	}
+	return err
+}
+
+func syncPages(db *KV) error {
+	resetPages(db)
+	return masterSync(db)
+}
 
-	db.page.flushed += pageNewCount
+// the pending pages are written to the mmap
+func resetPages(db *KV) {
+	db.page.flushed += uint64(db.page.nappend)
+	if !db.deferred() {
+		db.page.nfree = 0
+	}
+	db.page.nappend = 0
 	db.page.updates = make(map[uint64][]byte)
+}
+
+// make the written pages durable and point the master page to them
+func masterSync(db *KV) error {
+	defer unlockReaders(db) // the readers can open the new version
+	// the data pages must be durable before the master page points to them
+	if err := dbSync(db); err != nil {
+		return err
+	}
 
 	// update & flush the master page
-	if err := materStore(db); err != nil {
-		return fmt.Errorf("materstore: %w", err)
+	if err := masterStore(db, false); err != nil {
+		return fmt.Errorf("masterstore: %w", err)
 	}
 
+	return dbSync(db)
+}
+
+func dbSync(db *KV) error {
+	if db.Sync == SYNC_NONE {
+		return nil
+	}
 	if err := db.fp.Sync(); err != nil {
 		return fmt.Errorf("fsync: %w", err)
 	}
-
 	return nil
 }
 
@@ -285,8 +663,19 @@ func writePages(db *KV) error {
 			freed = append(freed, ptr)
 		}
 	}
-	db.free.Update(db.page.nfree, freed)
+	if !db.deferred() {
+		db.free.Update(db.page.nfree, releasePages(db, freed))
+	} else if len(freed) > 0 {
+		// released by the next checkpoint
+		pinned := pinnedPages{version: db.version + 1, ptrs: freed}
+		db.mu.Lock()
+		db.pinned = append(slices.Clip(db.pinned), pinned)
+		db.mu.Unlock()
+	}
+	return copyPages(db)
+}
 
+func copyPages(db *KV) error {
 	// extend the file & mmap if needed
 	npages := int(db.page.flushed) + db.page.nappend
 	if err := extendFile(db, npages); err != nil {
@@ -300,7 +689,9 @@ func writePages(db *KV) error {
 	// copy data to the file
 	for ptr, page := range db.page.updates {
 		if page != nil {
-			copy(db.pageGetMapped(ptr).data, page)
+			node := mmapPage(db.mmap.chunks, ptr, db.PageSize)
+			copy(node.data, page[:min(len(page), nodeSize(db.PageSize))])
+			pageChecksum(node)
 		}
 	}
 	return nil
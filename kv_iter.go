@@ -0,0 +1,159 @@
+package tinydb
+
+import "bytes"
+
+// KVIter the common interface of the iterators
+type KVIter interface {
+	Valid() bool
+	Key() []byte
+	Val() []byte
+	Next()
+	Prev()
+	Err() error // the error that invalidated the iterator
+}
+
+// the iterator of a transaction.
+// it merges the pending updates (top) into the snapshot (bottom).
+type txIter struct {
+	tx    *KVTX
+	top   *BIter
+	bot   *BIter
+	dir   int       // +1: forward, -1: backward
+	onTop bool      // the current key is from the pending updates
+	rng   *keyRange // the visited keys, recorded as reads
+}
+
+func newTxIter(tx *KVTX, key []byte, dir int) *txIter {
+	it := &txIter{tx: tx, dir: dir}
+	if dir > 0 {
+		it.top, it.bot = tx.pending.Seek(key), tx.snapshot.Seek(key)
+	} else {
+		it.top, it.bot = tx.pending.SeekLE(key), tx.snapshot.SeekLE(key)
+	}
+	key = bytes.Clone(key)
+	it.rng = &keyRange{start: key, stop: key}
+	tx.reads = append(tx.reads, it.rng)
+	it.settle()
+	return it
+}
+
+func (it *txIter) Valid() bool {
+	return it.Err() == nil && (it.onTop || it.bot.Valid())
+}
+
+// Err only the snapshot is read from the disk
+func (it *txIter) Err() error {
+	return it.bot.Err()
+}
+
+func (it *txIter) Key() []byte {
+	if it.onTop {
+		return it.top.Key()
+	}
+	return it.bot.Key()
+}
+
+func (it *txIter) Val() []byte {
+	if it.onTop {
+		return it.top.Val()[1:]
+	}
+	return it.bot.Val()
+}
+
+func (it *txIter) Next() {
+	it.move(+1)
+}
+
+func (it *txIter) Prev() {
+	it.move(-1)
+}
+
+func (it *txIter) move(dir int) {
+	if dir != it.dir {
+		it.turn(dir)
+	} else if it.Valid() {
+		// step past the current key
+		if it.onTop && it.bot.Valid() && bytes.Equal(it.top.Key(), it.bot.Key()) {
+			it.step(it.bot) // the key is shadowed by the pending update
+		}
+		if it.onTop {
+			it.step(it.top)
+		} else {
+			it.step(it.bot)
+		}
+	}
+	it.settle()
+}
+
+// reverse the direction and move past the current key
+func (it *txIter) turn(dir int) {
+	it.dir = dir
+	if !it.Valid() {
+		// both are past the same end
+		it.step(it.top)
+		it.step(it.bot)
+		return
+	}
+
+	key := bytes.Clone(it.Key())
+	if dir > 0 {
+		it.top, it.bot = it.tx.pending.Seek(key), it.tx.snapshot.Seek(key)
+	} else {
+		it.top, it.bot = it.tx.pending.SeekLE(key), it.tx.snapshot.SeekLE(key)
+	}
+	for _, iter := range []*BIter{it.top, it.bot} {
+		if iter.Valid() && bytes.Equal(iter.Key(), key) {
+			it.step(iter)
+		}
+	}
+}
+
+func (it *txIter) step(iter *BIter) {
+	if it.dir > 0 {
+		iter.Next()
+	} else {
+		iter.Prev()
+	}
+}
+
+// pick the current key from the top or the bottom, skip the deleted keys
+func (it *txIter) settle() {
+	for {
+		if !it.top.Valid() {
+			it.onTop = false
+			break
+		}
+		cmp := -1 // the top is in front if the bottom is done
+		if it.bot.Valid() {
+			cmp = it.dir * bytes.Compare(it.top.Key(), it.bot.Key())
+		}
+		if cmp > 0 {
+			it.onTop = false
+			break
+		}
+		if it.top.Val()[0] == FLAG_DELETED {
+			if cmp == 0 {
+				it.step(it.bot)
+			}
+			it.step(it.top)
+			continue
+		}
+		it.onTop = true
+		break
+	}
+	it.record()
+}
+
+// extend the read range to the current key
+func (it *txIter) record() {
+	switch {
+	case !it.Valid() && it.dir > 0:
+		it.rng.stop = nil // till the last key
+	case !it.Valid():
+		it.rng.start = nil // from the first key
+	case bytes.Compare(it.Key(), it.rng.start) < 0:
+		it.rng.start = bytes.Clone(it.Key())
+	case it.rng.stop != nil && bytes.Compare(it.Key(), it.rng.stop) > 0:
+		it.rng.stop = bytes.Clone(it.Key())
+	}
+}
@@ -0,0 +1,109 @@
+package tinydb
+
+// KVReader a read-only transaction.
+// it pins the root of the last committed version and sees a consistent
+// snapshot while a writer proceeds. this works because the B-tree is
+// copy-on-write: the pages of a version are never modified, and they
+// are not reused until all readers of that version are done.
+type KVReader struct {
+	db      *KV
+	version uint64
+	tree    BTree    // the snapshot
+	mmap    [][]byte // the mmap chunks when the reader started
+	done    bool
+}
+
+// pages freed by a version, they are visible to older versions
+type pinnedPages struct {
+	version uint64
+	ptrs    []uint64
+}
+
+// BeginRead start a read-only transaction
+func (db *KV) BeginRead() *KVReader {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	r := &KVReader{db: db, version: db.version}
+	r.mmap = db.mmap.chunks
+	r.tree.root = db.root
+	r.tree.pageSize = db.PageSize
+	r.tree.get = func(ptr uint64) BNode {
+		return pageVerify(ptr, mmapPage(r.mmap, ptr, db.PageSize))
+	}
+	db.readers[r] = struct{}{}
+	return r
+}
+
+// EndRead finish the read-only transaction, the iterators are invalidated
+func (r *KVReader) EndRead() {
+	if r.done {
+		return
+	}
+	r.done = true
+
+	r.db.mu.Lock()
+	delete(r.db.readers, r)
+	r.db.mu.Unlock()
+}
+
+// Get read a key
+func (r *KVReader) Get(key []byte) ([]byte, bool, error) {
+	return r.tree.Get(key)
+}
+
+// Seek return an iterator at the first key that is greater or equal to the key
+func (r *KVReader) Seek(key []byte) *BIter {
+	return r.tree.Seek(key)
+}
+
+// SeekLE return an iterator at the last key that is less or equal to the key
+func (r *KVReader) SeekLE(key []byte) *BIter {
+	return r.tree.SeekLE(key)
+}
+
+// ReadIter the iterator of KV.Seek with its own snapshot.
+// the pages of the snapshot are not reused until it's closed.
+type ReadIter struct {
+	*BIter
+	r *KVReader
+}
+
+// Close end the snapshot, the iterator is invalidated
+func (it *ReadIter) Close() {
+	it.r.EndRead()
+}
+
+// pin the pages freed by the version being committed, and return the
+// pinned pages that are no longer visible to any reader.
+func releasePages(db *KV, freed []uint64) []uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// new readers start at the current version, thus the pages
+	// freed by the next version can't be reused in this commit.
+	oldest := db.version
+	for r := range db.readers {
+		oldest = min(oldest, r.version)
+	}
+
+	if len(db.pinned) > 0 && !lockReaders(db) {
+		// the readers of other processes can see any of the pages
+		oldest = 0
+	}
+
+	var reusable []uint64
+	var pinned []pinnedPages // don't modify the slice, it's saved for the rollback
+	for _, p := range db.pinned {
+		if p.version <= oldest {
+			reusable = append(reusable, p.ptrs...)
+		} else {
+			pinned = append(pinned, p)
+		}
+	}
+	if len(freed) > 0 {
+		pinned = append(pinned, pinnedPages{version: db.version + 1, ptrs: freed})
+	}
+	db.pinned = pinned
+	return reusable
+}
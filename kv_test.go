@@ -2,20 +2,31 @@ package tinydb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
-const KV_PATH = "archive/testkv"
-
 func TestKv(t *testing.T) {
-	phrase1(t)
+	path := filepath.Join(t.TempDir(), "testkv")
+	phrase1(t, path)
 	// interrupted
-	phrase2(t)
+	phrase2(t, path)
 }
 
-func phrase2(t *testing.T) {
-	db, err := NewDB(KV_PATH)
+func phrase2(t *testing.T, path string) {
+	db, err := NewDB(path, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,7 +65,7 @@ func phrase2(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		if got1, got2 := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
+		if got1, got2, _ := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
 			log.Fatal("key:", test.key, " exists:", test.exists, " value:", string(got1))
 		}
 	}
@@ -87,14 +98,14 @@ func phrase2(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		if got1, got2 := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
+		if got1, got2, _ := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
 			log.Fatal("key:", test.key, " exists:", test.exists, " value:", string(got1))
 		}
 	}
 }
 
-func phrase1(t *testing.T) {
-	db, err := NewDB(KV_PATH)
+func phrase1(t *testing.T, path string) {
+	db, err := NewDB(path, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,7 +144,7 @@ func phrase1(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		if got1, got2 := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
+		if got1, got2, _ := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
 			log.Fatal("key:", test.key, " exists:", test.exists, " value:", string(got1))
 		}
 	}
@@ -166,7 +177,7 @@ func phrase1(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		if got1, got2 := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
+		if got1, got2, _ := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
 			log.Fatal("key:", test.key, " exists:", test.exists, " value:", string(got1))
 		}
 	}
@@ -203,8 +214,1822 @@ func phrase1(t *testing.T) {
 		},
 	}
 	for _, test := range tests {
-		if got1, got2 := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
+		if got1, got2, _ := db.Get([]byte(test.key)); got2 != test.exists || !bytes.Equal(got1, test.value) {
 			log.Fatal("key:", test.key, " exists:", test.exists, " value:", string(got1))
 		}
 	}
 }
+
+func TestKvSeek(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"user:3", "post:1", "user:1", "user:2", "post:2"} {
+		if err := db.Set([]byte(k), []byte("v"+k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// prefix listing
+	var got []string
+	iter := db.Seek([]byte("user:"))
+	for ; iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), []byte("user:")) {
+			break
+		}
+		got = append(got, string(iter.Key()))
+	}
+	iter.Close()
+	if !slices.Equal(got, []string{"user:1", "user:2", "user:3"}) {
+		t.Fatal("bad prefix listing:", got)
+	}
+
+	// the iterator reads a snapshot while the writer proceeds
+	iter = db.SeekLE([]byte("user:9"))
+	defer iter.Close()
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := db.Set([]byte(fmt.Sprintf("user:%d", i)), []byte("new")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	got = nil
+	for ; iter.Valid(); iter.Prev() {
+		got = append(got, string(iter.Key())+"="+string(iter.Val()))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, []string{"user:3=vuser:3", "user:2=vuser:2", "user:1=vuser:1", "post:2=vpost:2", "post:1=vpost:1"}) {
+		t.Fatal("bad snapshot:", got)
+	}
+}
+
+func TestKvTX(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the aborted updates are discarded
+	tx := db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i)))
+	}
+	tx.Delete([]byte("a"))
+	if _, ok, _ := tx.Get([]byte("k10")); !ok {
+		t.Fatal("must see its own updates")
+	}
+	tx.Abort()
+	if val, ok, _ := db.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatal("aborted delete")
+	}
+	if _, ok, _ := db.Get([]byte("k10")); ok {
+		t.Fatal("aborted insert")
+	}
+
+	// the committed updates are persisted together
+	tx = db.Begin()
+	for i := 0; i < 1000; i++ {
+		tx.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", i)))
+	}
+	tx.Delete([]byte("a"))
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Abort() // no-op
+	db.Close()
+
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok, _ := db.Get([]byte("a")); ok {
+		t.Fatal("a must be deleted")
+	}
+	for i := 0; i < 1000; i++ {
+		if val, ok, _ := db.Get([]byte(fmt.Sprint("k", i))); !ok || string(val) != fmt.Sprint("v", i) {
+			t.Fatal("missing key", i)
+		}
+	}
+}
+
+func TestKvReader(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const N = 200
+	for i := 0; i < N; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the snapshot is not affected by later commits
+	r := db.BeginRead()
+	tx := db.Begin()
+	tx.Set([]byte("k0"), []byte("uncommitted"))
+	if val, _, _ := r.Get([]byte("k0")); string(val) != "v0" {
+		t.Fatal("uncommitted update is visible")
+	}
+	tx.Abort()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 1; round <= 20; round++ {
+			tx := db.Begin()
+			for i := 0; i < N; i++ {
+				tx.Set([]byte(fmt.Sprint("k", i)), []byte(fmt.Sprint("v", round)))
+			}
+			tx.Delete([]byte("k7"))
+			if err := tx.Commit(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	// concurrent readers see consistent versions
+	for j := 0; j < 20; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := db.BeginRead()
+			defer r.EndRead()
+			iter := r.Seek([]byte("k"))
+			first := string(iter.Val())
+			for ; iter.Valid(); iter.Next() {
+				if string(iter.Val()) != first {
+					t.Error("inconsistent snapshot")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	count := 0
+	for iter := r.Seek([]byte("k")); iter.Valid(); iter.Next() {
+		if string(iter.Val()) != "v0" {
+			t.Fatal("the snapshot is modified")
+		}
+		count++
+	}
+	if count != N {
+		t.Fatal("the snapshot is modified")
+	}
+	r.EndRead()
+
+	if val, _, _ := db.Get([]byte("k0")); string(val) != "v20" {
+		t.Fatal("bad value", string(val))
+	}
+	if _, ok, _ := db.Get([]byte("k7")); ok {
+		t.Fatal("k7 must be deleted")
+	}
+}
+
+func TestKvTXIter(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "c", "e", "g"} {
+		if err := db.Set([]byte(k), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx := db.Begin()
+	defer tx.Abort()
+	tx.Set([]byte("b"), []byte("new"))
+	tx.Set([]byte("c"), []byte("new"))
+	tx.Delete([]byte("e"))
+	tx.Set([]byte("h"), []byte("new"))
+	tx.Set([]byte("x"), []byte("new"))
+	tx.Delete([]byte("x"))
+
+	collect := func(iter KVIter, dir int) (out []string) {
+		for iter.Valid() {
+			out = append(out, string(iter.Key())+"="+string(iter.Val()))
+			if dir > 0 {
+				iter.Next()
+			} else {
+				iter.Prev()
+			}
+		}
+		return out
+	}
+	all := []string{"a=old", "b=new", "c=new", "g=old", "h=new"}
+	if got := collect(tx.Seek([]byte("a")), +1); !slices.Equal(got, all) {
+		t.Fatal("forward:", got)
+	}
+	if got := collect(tx.SeekLE([]byte("z")), -1); !slices.Equal(got, []string{"h=new", "g=old", "c=new", "b=new", "a=old"}) {
+		t.Fatal("backward:", got)
+	}
+	if got := collect(tx.Seek([]byte("d")), +1); !slices.Equal(got, all[3:]) {
+		t.Fatal("seek:", got)
+	}
+
+	// change the direction
+	iter := tx.Seek([]byte("c"))
+	iter.Next()
+	iter.Prev()
+	if string(iter.Key()) != "c" {
+		t.Fatal("turn back:", string(iter.Key()))
+	}
+	iter.Prev()
+	iter.Next()
+	iter.Next()
+	if string(iter.Key()) != "g" {
+		t.Fatal("turn forward:", string(iter.Key()))
+	}
+	for iter.Valid() {
+		iter.Next()
+	}
+	iter.Prev()
+	if string(iter.Key()) != "h" {
+		t.Fatal("back from the end:", string(iter.Key()))
+	}
+}
+
+func TestKvConflict(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "c", "e"} {
+		if err := db.Set([]byte(k), []byte("0")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// read-write conflict on a key
+	tx1, tx2 := db.Begin(), db.Begin()
+	tx1.Get([]byte("a"))
+	tx1.Set([]byte("b"), []byte("1"))
+	tx2.Set([]byte("a"), []byte("2"))
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatal("must conflict:", err)
+	}
+	if _, ok, _ := db.Get([]byte("b")); ok {
+		t.Fatal("conflicted updates are applied")
+	}
+
+	// the key buffer is reused after the read
+	reads := []func(tx *KVTX, key []byte){
+		func(tx *KVTX, key []byte) { tx.Get(key) },
+		func(tx *KVTX, key []byte) { tx.OpenBlob(key) },
+	}
+	for _, read := range reads {
+		tx1, tx2 = db.Begin(), db.Begin()
+		buf := []byte("a")
+		read(tx1, buf)
+		buf[0] = 'q'
+		tx1.Set([]byte("b"), []byte("1"))
+		tx2.Set([]byte("a"), []byte("3"))
+		if err := tx2.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx1.Commit(); !errors.Is(err, ErrConflict) {
+			t.Fatal("must conflict:", err)
+		}
+	}
+
+	// read-write conflict on a range
+	tx1, tx2, tx3 := db.Begin(), db.Begin(), db.Begin()
+	for iter := tx1.Seek([]byte("b")); iter.Valid() && string(iter.Key()) < "d"; iter.Next() {
+	}
+	tx1.Set([]byte("z"), []byte("1"))
+	tx2.Set([]byte("f"), []byte("2")) // not in the range
+	tx3.Set([]byte("b"), []byte("3")) // in the range
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx3.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); !errors.Is(err, ErrConflict) {
+		t.Fatal("must conflict:", err)
+	}
+
+	// non-conflicting transactions are applied in order
+	tx1, tx2 = db.Begin(), db.Begin()
+	tx1.Get([]byte("a"))
+	tx1.Set([]byte("x"), []byte("1"))
+	tx2.Get([]byte("c"))
+	tx2.Set([]byte("y"), []byte("2"))
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"x": "1", "y": "2", "f": "2", "b": "3"} {
+		if val, _, _ := db.Get([]byte(k)); string(val) != v {
+			t.Fatal("bad value", k, string(val))
+		}
+	}
+}
+
+func TestKvConcurrentWriters(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const workers, rounds = 8, 10
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				for {
+					// increment a counter
+					tx := db.Begin()
+					n := 0
+					if val, ok, _ := tx.Get([]byte("counter")); ok {
+						n, _ = strconv.Atoi(string(val))
+					}
+					tx.Set([]byte("counter"), []byte(strconv.Itoa(n+1)))
+					err := tx.Commit()
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if val, _, _ := db.Get([]byte("counter")); string(val) != strconv.Itoa(workers*rounds) {
+		t.Fatal("lost updates:", string(val))
+	}
+}
+
+// close the db without flushing anything, as if the process was killed
+func kvCrash(db *KV) {
+	for _, chunk := range db.mmap.chunks {
+		_ = syscall.Munmap(chunk)
+	}
+	if db.wal.fp != nil {
+		_ = db.wal.fp.Close()
+	}
+	if db.lock.fp != nil {
+		_ = db.lock.fp.Close()
+	}
+	_ = db.fp.Close()
+}
+
+func TestKvMasterRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := db.Set([]byte("k"), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seq := db.master.seq
+	kvCrash(db)
+
+	// tear the newest master slot, the previous version is recovered
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	torn := make([]byte, MASTER_SIZE/2)
+	if _, err := fp.WriteAt(torn, int64(seq%2)*MASTER_SLOT_SIZE+MASTER_SIZE/2); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := db.Get([]byte("k")); string(val) != "v1" {
+		t.Fatalf("recovered %q", val)
+	}
+	if db.master.seq != seq-1 {
+		t.Fatal("bad master seq")
+	}
+	// the next update overwrites the torn slot
+	if err := db.Set([]byte("k"), []byte("v3")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := db.Get([]byte("k")); string(val) != "v3" {
+		t.Fatalf("got %q", val)
+	}
+	db.Close()
+
+	// both slots are bad
+	if _, err := fp.WriteAt(make([]byte, 2*MASTER_SLOT_SIZE), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDB(path, nil); err == nil {
+		t.Fatal("opened with a bad master page")
+	}
+}
+
+func TestKvCrashLeak(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "testkv")
+		used := uint64(0)
+		for round := 0; round < 5; round++ {
+			db, err := NewDB(path, &Options{WAL: wal})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the pages freed by the last commits are pinned
+			for i := 0; i < 100; i++ {
+				key := []byte(fmt.Sprint("k", i%10))
+				if err := db.Set(key, bytes.Repeat(key, 100+i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			kvCrash(db)
+
+			// the pinned pages are leaked, but the file is not corrupted
+			if !wal {
+				db, err = NewDB(path, &Options{ReadOnly: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := db.Verify(); !errors.Is(err, ErrLeaked) || errors.Is(err, ErrCorrupted) {
+					t.Fatal(round, err)
+				}
+				db.Close()
+			}
+
+			// the pinned pages are reclaimed by the next open
+			db, err = NewDB(path, &Options{WAL: wal})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Verify(); err != nil {
+				t.Fatal(round, err)
+			}
+			if round == 1 {
+				used = db.page.flushed
+			} else if round > 1 && db.page.flushed > used {
+				t.Fatalf("the file grows from %d to %d pages", used, db.page.flushed)
+			}
+			db.Close()
+		}
+	}
+}
+
+func TestKvCleanClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	clean := func() bool {
+		db, err := NewDB(path, &Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		return db.master.clean
+	}
+	set := func(db *KV, n int) {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprint("k", i%10))
+			if err := db.Set(key, bytes.Repeat(key, 100+i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// the leaked pages are reclaimed and the file is closed cleanly
+	reopen := func() {
+		db, err := NewDB(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+		if !clean() {
+			t.Fatal("not clean after close")
+		}
+	}
+
+	// the leaked pages are looked for only after an unclean close
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(db, 100)
+	db.Close()
+	if !clean() {
+		t.Fatal("not clean after close")
+	}
+
+	// the pages pinned for a reader of another process are not freed
+	reader, err := NewDB(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(db, 100)
+	db.Close()
+	reader.Close()
+	if clean() {
+		t.Fatal("clean with the pinned pages")
+	}
+	reopen()
+
+	// the leaked pages are not reclaimed while the file is read by others
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(db, 100)
+	kvCrash(db)
+	if clean() {
+		t.Fatal("clean after a crash")
+	}
+	reader, err = NewDB(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	reader.Close()
+	if clean() {
+		t.Fatal("clean with the leaked pages")
+	}
+	reopen()
+
+	// so are the pages of an unfinished blob
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := db.CreateBlob([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 10000)); err != nil {
+		t.Fatal(err)
+	}
+	set(db, 10)
+	db.Close()
+	if clean() {
+		t.Fatal("clean with the reserved pages")
+	}
+	reopen()
+}
+
+func TestKvCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// flip a bit of the root node
+	root := db.tree.root
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	off := int64(root*BTREE_PAGE_SIZE + 2)
+	b := make([]byte, 1)
+	if _, err := fp.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt([]byte{b[0] ^ 1}, off); err != nil {
+		t.Fatal(err)
+	}
+
+	checkErr := func(err error) {
+		t.Helper()
+		var pe *PageError
+		if !errors.Is(err, ErrCorrupted) || !errors.As(err, &pe) || pe.Page != root {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	_, _, err = db.Get([]byte("k1"))
+	checkErr(err)
+	checkErr(db.Set([]byte("k1"), []byte("x")))
+	iter := db.BeginRead().Seek([]byte("k"))
+	if iter.Valid() {
+		t.Fatal("the iterator must be invalid")
+	}
+	checkErr(iter.Err())
+
+	// the failed commit is rolled back
+	if _, err := fp.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k1"), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := db.Get([]byte("k1")); string(val) != "x" {
+		t.Fatalf("got %q", val)
+	}
+}
+
+func TestKvOverflow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	big := func(i int) []byte {
+		return bytes.Repeat([]byte{byte(i)}, 50000+i)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), big(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a snapshot keeps the old chain
+	r := db.BeginRead()
+	if err := db.Set([]byte("k0"), []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := r.Get([]byte("k0")); !bytes.Equal(val, big(0)) {
+		t.Fatal("the snapshot is modified")
+	}
+	r.EndRead()
+
+	// the freed pages are reused
+	for round := 0; round < 10; round++ {
+		if err := db.Set([]byte("k1"), big(round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := db.page.flushed
+	for round := 0; round < 10; round++ {
+		if err := db.Set([]byte("k1"), big(round)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.page.flushed != used {
+		t.Fatalf("the file grows from %d to %d pages", used, db.page.flushed)
+	}
+	db.Close()
+
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 1; i < 10; i++ {
+		want := big(i)
+		if i == 1 {
+			want = big(9)
+		}
+		if val, _, err := db.Get([]byte(fmt.Sprint("k", i))); err != nil || !bytes.Equal(val, want) {
+			t.Fatalf("k%d: %v", i, err)
+		}
+	}
+	if deleted, err := db.Delete([]byte("k2")); err != nil || !deleted {
+		t.Fatal("delete failed")
+	}
+}
+
+func TestKvBlob(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	data := make([]byte, 200000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	w, err := db.CreateBlob([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1000+len(rest)%7777)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := db.OpenBlob([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(b)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read blob: %v", err)
+	}
+	for _, off := range []int64{150000, 5000, int64(overflowCap(BTREE_PAGE_SIZE)), 0} {
+		if _, err := b.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 10000)
+		if _, err := io.ReadFull(b, buf); err != nil || !bytes.Equal(buf, data[off:][:10000]) {
+			t.Fatalf("read at %d: %v", off, err)
+		}
+	}
+	b.Close()
+
+	// also readable as a normal value
+	if val, ok, err := db.Get([]byte("blob")); err != nil || !ok || !bytes.Equal(val, data) {
+		t.Fatal("get blob")
+	}
+	// inline values
+	if err := db.Set([]byte("small"), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b, err = db.OpenBlob([]byte("small"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(b); string(got) != "hello" {
+		t.Fatalf("got %q", got)
+	}
+	b.Close()
+	if _, err := db.OpenBlob([]byte("none")); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+
+	// the pages of an aborted blob are returned to the free list
+	w, _ = db.CreateBlob([]byte("aborted"))
+	w.Write(data)
+	w.Abort()
+	used := db.page.flushed
+	for i := 0; i < 3; i++ {
+		db.Set([]byte("x"), nil) // release the pinned pages
+	}
+	if err := db.Set([]byte("big"), data[:100000]); err != nil {
+		t.Fatal(err)
+	}
+	if db.page.flushed > used+2 { // 25 pages for the value
+		t.Fatalf("the file grows from %d to %d pages", used, db.page.flushed)
+	}
+	if _, err := db.OpenBlob([]byte("aborted")); !errors.Is(err, ErrNotFound) {
+		t.Fatal(err)
+	}
+}
+
+func TestKvPageSize(t *testing.T) {
+	for _, size := range []int{BTREE_PAGE_SIZE_MIN, 16 << 10} {
+		path := filepath.Join(t.TempDir(), "testkv")
+		db, err := NewDB(path, &Options{PageSize: size})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := map[string][]byte{}
+		for i := 0; i < 2000; i++ {
+			key := fmt.Sprintf("key%d", (i*7919)%2000)
+			if i%100 == 0 {
+				key = strings.Repeat(key, maxKeySize(size))[:maxKeySize(size)]
+			}
+			val := bytes.Repeat([]byte{byte(i)}, i%50)
+			if i%300 == 0 {
+				val = bytes.Repeat([]byte{byte(i)}, 3*size) // overflow pages
+			}
+			if err := db.Set([]byte(key), val); err != nil {
+				t.Fatal(err)
+			}
+			keys[key] = val
+		}
+		if err := db.Set(make([]byte, maxKeySize(size)+1), nil); !errors.Is(err, ErrKeyTooLarge) {
+			t.Fatal(err)
+		}
+		db.Close()
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size()%int64(size) != 0 {
+			t.Fatalf("file size %d", fi.Size())
+		}
+
+		// the size is read from the file
+		db, err = NewDB(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.PageSize != size {
+			t.Fatalf("page size %d", db.PageSize)
+		}
+		for key, want := range keys {
+			if val, ok, err := db.Get([]byte(key)); err != nil || !ok || !bytes.Equal(val, want) {
+				t.Fatalf("%s: %v", key, err)
+			}
+		}
+		db.Close()
+
+		if _, err := NewDB(path, &Options{PageSize: BTREE_PAGE_SIZE}); !errors.Is(err, ErrPageSize) {
+			t.Fatal(err)
+		}
+	}
+
+	for _, size := range []int{512, 3000, 64 << 10} {
+		if _, err := NewDB(filepath.Join(t.TempDir(), "testkv"), &Options{PageSize: size}); err == nil {
+			t.Fatalf("page size %d", size)
+		}
+	}
+}
+
+func TestKvOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, opts := range []Options{
+		{Sync: 5}, {MmapSize: 1000}, {MaxMmapSize: -1}, {FileGrowth: -1},
+		{MmapSize: 2 * BTREE_PAGE_SIZE_MAX, MaxMmapSize: BTREE_PAGE_SIZE_MAX},
+	} {
+		if _, err := NewDB(filepath.Join(dir, "bad"), &opts); err == nil {
+			t.Fatalf("%+v", opts)
+		}
+	}
+
+	var logs bytes.Buffer
+	path := filepath.Join(dir, "testkv")
+	db, err := NewDB(path, &Options{
+		Sync:        SYNC_NONE,
+		MmapSize:    BTREE_PAGE_SIZE_MAX,
+		MaxMmapSize: 1 << 20,
+		FileGrowth:  64 << 10,
+		FileMode:    0600,
+		Logger:      log.New(&logs, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || fi.Size() != 64<<10 {
+		t.Fatalf("%v %d", fi.Mode(), fi.Size())
+	}
+
+	// the mmap is extended up to the limit
+	val := make([]byte, 1000)
+	n := 0
+	for ; n < 10000; n++ {
+		if err := db.Set([]byte(fmt.Sprint("key", n)), val); err != nil {
+			break
+		}
+	}
+	if n == 10000 || len(db.mmap.chunks) < 2 || db.mmap.total > 1<<20 {
+		t.Fatalf("%d keys, %d chunks", n, len(db.mmap.chunks))
+	}
+	for i := 0; i < n; i++ {
+		if _, ok, err := db.Get([]byte(fmt.Sprint("key", i))); err != nil || !ok {
+			t.Fatal(i, err)
+		}
+	}
+	seq := db.master.seq
+	db.Close()
+
+	// a torn master page is logged
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.WriteAt([]byte{0xff}, int64(seq%2)*MASTER_SLOT_SIZE+MASTER_SIZE-1)
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(path, &Options{Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if !strings.Contains(logs.String(), "torn") {
+		t.Fatal(logs.String())
+	}
+
+	// the file is not written in the read-only mode,
+	// and the lock file is not created
+	if err := os.Remove(lockPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDB(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(lockPath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("the lock file is created:", err)
+	}
+	if _, ok, err := db.Get([]byte("key0")); err != nil || !ok {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key0"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatal(err)
+	}
+}
+
+func TestKvLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*Options{nil, {LockTimeout: 20 * time.Millisecond}} {
+		if _, err := NewDB(path, opts); !errors.Is(err, ErrLocked) {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+	}
+
+	// wait for the writer to close
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		db.Close()
+	}()
+	db, err = NewDB(path, &Options{LockTimeout: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the readers don't exclude the writer
+	r, err := NewDB(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := db.page.flushed
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the reader sees the version when it's opened, the pages are not reused
+	for i := 0; i < 100; i++ {
+		if val, _, err := r.Get([]byte(fmt.Sprint("k", i))); err != nil || string(val) != "v1" {
+			t.Fatal(string(val), err)
+		}
+	}
+	if _, err := db.Compact(); err != nil || db.page.flushed < used {
+		t.Fatal("truncated under the reader:", err)
+	}
+	r.Close()
+
+	// the pages are reused after the reader is closed
+	for i := 0; i < 10; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v3")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used = db.page.flushed
+	for i := 0; i < 100; i++ {
+		if err := db.Set([]byte(fmt.Sprint("k", i)), []byte("v4")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.page.flushed != used {
+		t.Fatalf("the file grows from %d to %d pages", used, db.page.flushed)
+	}
+	db.Close()
+
+	// the log of a writer is skipped, the reader sees the last checkpoint
+	db, err = NewDB(path, &Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k0"), []byte("v5")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = NewDB(path, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, _, err := r.Get([]byte("k0")); err != nil || string(val) != "v4" {
+		t.Fatal(string(val), err)
+	}
+	r.Close()
+
+	// the log of a crashed writer must be replayed by a writer
+	kvCrash(db)
+	if _, err := NewDB(path, &Options{ReadOnly: true}); err == nil {
+		t.Fatal("the log is skipped without a writer")
+	}
+
+	// the writers and the read-only opens don't make each other fail
+	done, errs := make(chan struct{}), make(chan error, 4)
+	var wg sync.WaitGroup
+	for j := 0; j < 4; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				r, err := NewDB(path, &Options{ReadOnly: true})
+				if err != nil {
+					errs <- err
+					return
+				}
+				r.Close()
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		db, err := NewDB(path, &Options{WAL: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set([]byte("k0"), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+		db.Close()
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvGroupCommit(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "testkv")
+		db, err := NewDB(path, &Options{Sync: SYNC_GROUP, SyncWindow: time.Millisecond, WAL: wal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := db.master.seq
+
+		const nworkers, nkeys = 8, 50
+		var wg sync.WaitGroup
+		for w := 0; w < nworkers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < nkeys; i++ {
+					key := []byte(fmt.Sprint("key", w, "-", i))
+					if err := db.Set(key, key); err != nil {
+						t.Error(err)
+						return
+					}
+					if i%5 == 0 {
+						if _, err := db.Delete(key); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		commits := nworkers * (nkeys + nkeys/5)
+		if n := int(db.master.seq - seq); !wal && n >= commits {
+			t.Fatalf("%d syncs for %d commits", n, commits)
+		}
+
+		// the returned commits survive a crash
+		kvCrash(db)
+		db, err = NewDB(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for w := 0; w < nworkers; w++ {
+			for i := 0; i < nkeys; i++ {
+				key := []byte(fmt.Sprint("key", w, "-", i))
+				val, ok, err := db.Get(key)
+				if err != nil || ok != (i%5 != 0) || (ok && !bytes.Equal(val, key)) {
+					t.Fatal(string(key), ok, err)
+				}
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestKvWAL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, &Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string][]byte{}
+	update := func(i int) {
+		key := fmt.Sprint("key", i%300)
+		if i%7 == 0 {
+			if _, err := db.Delete([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, key)
+			return
+		}
+		val := []byte(fmt.Sprint("val", i))
+		if i%50 == 0 {
+			val = bytes.Repeat(val, 3000) // overflow pages
+		}
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	verify := func() {
+		r := db.BeginRead()
+		defer r.EndRead()
+		n := 0
+		for iter := r.Seek(nil); iter.Valid(); iter.Next() {
+			key, val := iter.Key(), iter.Val()
+			if !bytes.Equal(ref[string(key)], val) {
+				t.Fatalf("%s", key)
+			}
+			n++
+		}
+		if n != len(ref) {
+			t.Fatalf("%d keys, expect %d", n, len(ref))
+		}
+	}
+
+	// the commits go to the log
+	seq := db.master.seq
+	for i := 0; i < 1000; i++ {
+		update(i)
+	}
+	if db.master.seq != seq || db.wal.size <= WAL_HEADER {
+		t.Fatal("the master page is updated")
+	}
+
+	// replayed after a crash, the torn record is discarded
+	kvCrash(db)
+	fp, err := os.OpenFile(walPath(path), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fp.Write([]byte{100, 0, 0, 0, 1, 2, 3})
+	fp.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	db, err = NewDB(path, &Options{WAL: true, CheckpointSize: 20 << 10, Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "torn") {
+		t.Fatal(logs.String())
+	}
+	verify()
+	if err := db.Verify(); err != nil {
+		t.Fatal(err) // the pages freed by the replay are not leaked
+	}
+
+	// the checkpoints keep the log small
+	seq = db.master.seq
+	for i := 1000; i < 3000; i++ {
+		update(i)
+	}
+	if db.master.seq == seq || db.wal.size > 20<<10 {
+		t.Fatalf("seq %d, log size %d", db.master.seq, db.wal.size)
+	}
+	w, err := db.CreateBlob([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := bytes.Repeat([]byte("blob"), 5000)
+	if _, err := w.Write(blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ref["blob"] = blob
+	update(3000)
+	verify()
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed without the WAL mode, the log is removed
+	kvCrash(db)
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := os.Stat(walPath(path)); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	verify()
+	for i := 3001; i < 4000; i++ {
+		update(i)
+	}
+	verify()
+}
+
+func TestKvBulkLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := map[string][]byte{}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%06d", i)) }
+	for i := 1; i < 2000; i += 2 {
+		val := []byte(fmt.Sprint("old", i))
+		if i%100 == 1 {
+			val = bytes.Repeat(val, 2000) // overflow pages
+		}
+		if err := db.Set(key(i), val); err != nil {
+			t.Fatal(err)
+		}
+		ref[string(key(i))] = val
+	}
+	verify := func() {
+		r := db.BeginRead()
+		defer r.EndRead()
+		n := 0
+		for iter := r.Seek(nil); iter.Valid(); iter.Next() {
+			if !bytes.Equal(ref[string(iter.Key())], iter.Val()) {
+				t.Fatalf("%s", iter.Key())
+			}
+			n++
+		}
+		if n != len(ref) {
+			t.Fatalf("%d keys, expect %d", n, len(ref))
+		}
+	}
+
+	// merged with the existing keys, the snapshot is not affected
+	r := db.BeginRead()
+	in := &sliceIter{}
+	for i := 0; i < 20000; i += 2 {
+		val := []byte(fmt.Sprint("new", i))
+		if i%1000 == 0 {
+			val = bytes.Repeat(val, 2000)
+		}
+		in.keys = append(in.keys, key(i))
+		in.vals = append(in.vals, val)
+		ref[string(key(i))] = val
+		if i%10 == 0 && i < 2000 {
+			in.keys = append(in.keys, key(i+1))
+			in.vals = append(in.vals, val)
+			ref[string(key(i+1))] = val
+		}
+	}
+	if err := db.BulkLoad(in, &BulkOptions{FillFactor: 0.8}); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := r.Get(key(1)); string(val) != string(bytes.Repeat([]byte("old1"), 2000)) {
+		t.Fatal("the snapshot is modified")
+	}
+	if _, ok, _ := r.Get(key(2)); ok {
+		t.Fatal("the snapshot is modified")
+	}
+	r.EndRead()
+	verify()
+
+	// only the pages around the input are rewritten
+	for _, keys := range [][]int{{20001, 20003}, {5001, 5003}, {0, 9001, 20005}} {
+		in = &sliceIter{}
+		for _, i := range keys {
+			in.keys = append(in.keys, key(i))
+			in.vals = append(in.vals, key(i))
+			ref[string(key(i))] = key(i)
+		}
+		flushed := db.page.flushed
+		if err := db.BulkLoad(in, nil); err != nil {
+			t.Fatal(err)
+		}
+		if n := db.page.flushed - flushed; n > 20 {
+			t.Fatalf("%d pages written for %d keys", n, len(keys))
+		}
+		verify()
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys out of order
+	in = &sliceIter{keys: [][]byte{key(30001), key(30000), key(3), key(30002)}, vals: [][]byte{{1}, {2}, {3}, {4}}}
+	err = db.BulkLoad(in, &BulkOptions{Strict: true})
+	if !errors.Is(err, ErrUnsorted) {
+		t.Fatal(err)
+	}
+	verify()
+	in.pos = 0
+	if err := db.BulkLoad(in, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range in.keys {
+		ref[string(k)] = in.vals[i]
+	}
+	verify()
+	if err := db.BulkLoad(&sliceIter{keys: [][]byte{nil}, vals: [][]byte{nil}}, nil); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// the tree is usable after reopening
+	db, err = NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	verify()
+	for i := 0; i < 6000; i += 3 {
+		if i%2 == 0 {
+			if _, err := db.Delete(key(i)); err != nil {
+				t.Fatal(err)
+			}
+			delete(ref, string(key(i)))
+		} else {
+			if err := db.Set(key(i), key(i)); err != nil {
+				t.Fatal(err)
+			}
+			ref[string(key(i))] = key(i)
+		}
+	}
+	verify()
+}
+
+func TestKvWriteBatch(t *testing.T) {
+	db, err := NewDB(filepath.Join(t.TempDir(), "testkv"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Set([]byte(k), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch := &WriteBatch{}
+	batch.Put([]byte("a"), []byte("new"))
+	batch.PutMode([]byte("b"), []byte("new"), MODE_INSERT_ONLY) // exists
+	batch.PutMode([]byte("x"), []byte("new"), MODE_UPDATE_ONLY) // missing
+	batch.PutMode([]byte("y"), []byte("new"), MODE_INSERT_ONLY)
+	batch.PutMode([]byte("y"), []byte("newer"), MODE_UPDATE_ONLY) // added by the batch
+	batch.Delete([]byte("c"))
+	batch.Delete([]byte("z"))
+	seq := db.master.seq
+	results, err := db.WriteBatch(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.master.seq != seq+1 {
+		t.Fatalf("%d flushes", db.master.seq-seq)
+	}
+	for i, ok := range []bool{true, false, false, true, true, true, false} {
+		if results[i].OK != ok || (results[i].Err != nil) != (i == 1 || i == 2) {
+			t.Fatal(i, results[i])
+		}
+	}
+	for k, v := range map[string]string{"a": "new", "b": "old", "y": "newer", "c": "", "x": ""} {
+		val, ok, err := db.Get([]byte(k))
+		if err != nil || ok != (v != "") || string(val) != v {
+			t.Fatal(k, string(val), err)
+		}
+	}
+
+	// a bad entry fails the whole batch
+	batch.Reset()
+	batch.Put([]byte("d"), nil)
+	batch.Put(nil, nil)
+	if _, err := db.WriteBatch(batch); !errors.Is(err, ErrEmptyKey) {
+		t.Fatal(err)
+	}
+	if _, ok, _ := db.Get([]byte("d")); ok {
+		t.Fatal("partially applied")
+	}
+}
+
+func TestKvVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i++ {
+		val := []byte("v")
+		if i%100 == 0 {
+			val = bytes.Repeat(val, 10000) // overflow pages
+		}
+		if err := db.Set([]byte(fmt.Sprint("k", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := db.BeginRead() // pins the freed pages
+	for i := 0; i < 2000; i += 3 {
+		if _, err := db.Delete([]byte(fmt.Sprint("k", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	r.EndRead()
+
+	// the pages of an unfinished blob are leaked
+	w, err := db.CreateBlob([]byte("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 3*BTREE_PAGE_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); !errors.Is(err, ErrLeaked) || errors.Is(err, ErrCorrupted) {
+		t.Fatal(err)
+	}
+	w.Abort()
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// swap the first 2 kids of the root
+	root := db.pageGet(db.tree.root)
+	if root.btype() != BNODE_NODE {
+		t.Fatal("the root is a leaf")
+	}
+	kid0, kid1 := root.getPtr(0), root.getPtr(1)
+	old := bytes.Clone(root.data)
+	page := NewBNode(bytes.Clone(root.data))
+	page.setPtr(0, kid1)
+	page.setPtr(1, kid0)
+	pageChecksum(page)
+	fp, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	off := int64(db.tree.root * BTREE_PAGE_SIZE)
+	if _, err := fp.WriteAt(page.data, off); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Verify()
+	var pe *PageError
+	if !errors.Is(err, ErrCorrupted) || !errors.As(err, &pe) || (pe.Page != kid0 && pe.Page != kid1) {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(old, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a prefix length beyond the page, the header size overflows
+	leaf := db.tree.root
+	for node := db.pageGet(leaf); node.btype() == BNODE_NODE; node = db.pageGet(leaf) {
+		leaf = node.getPtr(node.nkeys() - 1)
+	}
+	old = bytes.Clone(db.pageGet(leaf).data)
+	off = int64(leaf * BTREE_PAGE_SIZE)
+	page = NewBNode(bytes.Clone(old))
+	binary.LittleEndian.PutUint16(page.data[HEADER:], 0x10000-HEADER-2)
+	pageChecksum(page)
+	if _, err := fp.WriteAt(page.data, off); err != nil {
+		t.Fatal(err)
+	}
+	err = db.Verify()
+	if !errors.Is(err, ErrCorrupted) || !errors.As(err, &pe) || pe.Page != leaf || !strings.Contains(err.Error(), "too many keys") {
+		t.Fatal(err)
+	}
+	if _, err := fp.WriteAt(old, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB(filepath.Join(dir, "testkv"), &Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ref := map[string][]byte{}
+	for i := 0; i < 3000; i++ {
+		key, val := fmt.Sprint("k", i), []byte(fmt.Sprint("v", i))
+		if i%100 == 0 {
+			val = bytes.Repeat(val, 5000) // overflow pages
+		}
+		if err := db.Set([]byte(key), val); err != nil {
+			t.Fatal(err)
+		}
+		ref[key] = val
+	}
+	for i := 0; i < 3000; i += 2 {
+		key := fmt.Sprint("k", i)
+		if _, err := db.Delete([]byte(key)); err != nil {
+			t.Fatal(err)
+		}
+		delete(ref, key)
+	}
+
+	// the writer proceeds during the backup
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.Set([]byte(fmt.Sprintf("x%06d", i)), []byte("x")); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	var buf bytes.Buffer
+	err = db.Backup(&buf)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(buf.Len()/BTREE_PAGE_SIZE) >= db.page.flushed {
+		t.Fatal("the free pages are copied")
+	}
+
+	path := filepath.Join(dir, "backup")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if err := copied.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	// a consistent snapshot
+	r := copied.BeginRead()
+	n, x := 0, 0
+	for iter := r.Seek(nil); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		switch {
+		case key == "":
+		case key[0] == 'x':
+			if key != fmt.Sprintf("x%06d", x) {
+				t.Fatalf("%s is not the next update", key)
+			}
+			x++
+		case !bytes.Equal(ref[key], iter.Val()):
+			t.Fatalf("%s", key)
+		default:
+			n++
+		}
+	}
+	r.EndRead()
+	if n != len(ref) {
+		t.Fatalf("%d keys, expect %d", n, len(ref))
+	}
+	if err := copied.Set([]byte("new"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKvCompact(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "testkv")
+		db, err := NewDB(path, &Options{WAL: wal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := map[string][]byte{}
+		for i := 0; i < 5000; i++ {
+			key, val := fmt.Sprint("k", i), []byte(fmt.Sprint("v", i))
+			if i%200 == 0 {
+				val = bytes.Repeat(val, 5000) // overflow pages
+			}
+			if err := db.Set([]byte(key), val); err != nil {
+				t.Fatal(err)
+			}
+			ref[key] = val
+		}
+		for i := 0; i < 5000; i++ {
+			if i%10 != 0 {
+				key := fmt.Sprint("k", i)
+				if _, err := db.Delete([]byte(key)); err != nil {
+					t.Fatal(err)
+				}
+				delete(ref, key)
+			}
+		}
+		verify := func() {
+			if err := db.Verify(); err != nil {
+				t.Fatal(err)
+			}
+			r := db.BeginRead()
+			defer r.EndRead()
+			n := 0
+			for iter := r.Seek([]byte("k")); iter.Valid(); iter.Next() {
+				if !bytes.Equal(ref[string(iter.Key())], iter.Val()) {
+					t.Fatalf("%s", iter.Key())
+				}
+				n++
+			}
+			if n != len(ref) {
+				t.Fatalf("%d keys, expect %d", n, len(ref))
+			}
+		}
+		fileSize := func() int64 {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fi.Size()
+		}
+
+		// the pages are moved, but not truncated while they are visible
+		before := fileSize()
+		r := db.BeginRead()
+		iter := db.Seek([]byte("k"))
+		reclaimed, err := db.Compact()
+		if err != nil || reclaimed != 0 {
+			t.Fatal(reclaimed, err)
+		}
+		if val, _, err := r.Get([]byte("k0")); err != nil || !bytes.Equal(val, ref["k0"]) {
+			t.Fatal("the snapshot is modified")
+		}
+		r.EndRead()
+		verify()
+		if reclaimed, err := db.Compact(); err != nil || reclaimed != 0 {
+			t.Fatal("the iterator is not a reader:", reclaimed, err)
+		}
+		n := 0
+		for ; iter.Valid(); iter.Next() {
+			if !bytes.Equal(ref[string(iter.Key())], iter.Val()) {
+				t.Fatal("the iterator is modified")
+			}
+			n++
+		}
+		iter.Close()
+		if n != len(ref) {
+			t.Fatalf("%d keys, expect %d", n, len(ref))
+		}
+
+		reclaimed, err = db.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := fileSize()
+		if reclaimed <= 0 || after != before-reclaimed || after != int64(db.page.flushed)*BTREE_PAGE_SIZE {
+			t.Fatalf("reclaimed %d, from %d to %d", reclaimed, before, after)
+		}
+		// only the master page and a few free pages are left besides
+		// the pages of the tree and the overflow chains
+		live := 0
+		for _, owner := range verifyPages(db).owners {
+			if owner == PAGE_TREE || owner == PAGE_OVERFLOW {
+				live++
+			}
+		}
+		if int(db.page.flushed) > live+live/10+1 {
+			t.Fatalf("from %d to %d, %d pages are live", before, after, live)
+		}
+		verify()
+		if reclaimed, err := db.Compact(); err != nil || reclaimed != 0 {
+			t.Fatal(reclaimed, err)
+		}
+
+		// the file grows again
+		for i := 5000; i < 6000; i++ {
+			key, val := fmt.Sprint("k", i), []byte(fmt.Sprint("v", i))
+			if err := db.Set([]byte(key), val); err != nil {
+				t.Fatal(err)
+			}
+			ref[key] = val
+		}
+		verify()
+		db.Close()
+
+		db, err = NewDB(path, &Options{WAL: wal})
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify()
+		db.Close()
+	}
+}
+
+func TestKvStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "testkv")
+	db, err := NewDB(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	s, err := db.Stats()
+	if err != nil || s.Height != 0 || s.Keys != 0 || s.Pages != db.page.flushed {
+		t.Fatal(s, err)
+	}
+
+	for i := 0; i < 3000; i++ {
+		val := []byte("v")
+		if i%1000 == 0 {
+			val = bytes.Repeat(val, 3*BTREE_PAGE_SIZE) // 4 overflow pages
+		}
+		if err := db.Set([]byte(fmt.Sprint("k", i)), val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3000; i += 2 {
+		if _, err := db.Delete([]byte(fmt.Sprint("k", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Keys != 1500 || s.Height < 2 || s.InternalPages == 0 || s.OverflowPages != 0 {
+		t.Fatalf("%+v", s)
+	}
+	if s.FillFactor <= 0 || s.FillFactor > 1 {
+		t.Fatalf("%+v", s)
+	}
+	if s.PageSize != BTREE_PAGE_SIZE || s.Pages != db.page.flushed || s.FreePages != db.free.Total() ||
+		s.FileSize != fi.Size() || s.MmapSize < int(s.FileSize) || s.MmapChunks == 0 {
+		t.Fatalf("%+v", s)
+	}
+	// the master page, the free list, the tree
+	if used := 1 + s.InternalPages + s.LeafPages + s.OverflowPages; uint64(used) > s.Pages-s.FreePages {
+		t.Fatalf("%+v", s)
+	}
+
+	if err := db.Set([]byte("k1"), bytes.Repeat([]byte("v"), 3*BTREE_PAGE_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = db.Stats(); err != nil || s.OverflowPages != 4 {
+		t.Fatal(s, err)
+	}
+}
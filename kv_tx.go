@@ -0,0 +1,334 @@
+package tinydb
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"time"
+)
+
+// flags of the pending updates
+const (
+	FLAG_UPDATED = byte(1)
+	FLAG_DELETED = byte(2)
+)
+
+// KVTX a read-write transaction.
+// it reads from the snapshot it began with, and captures the updates
+// in memory. the updates are applied on top of the latest version and
+// made durable by a single write & fsync when committed.
+// transactions run concurrently, the commit fails with ErrConflict
+// if a key it read was updated by a transaction committed since it began.
+type KVTX struct {
+	db       *KV
+	snapshot *KVReader // the version the transaction began with
+	// the captured updates, the values are prefixed with a flag byte
+	pending BTree
+	reads   []*keyRange // for detecting conflicts
+	done    bool
+}
+
+// a range of keys [start, stop], nil stop denotes no upper bound
+type keyRange struct {
+	start []byte
+	stop  []byte
+}
+
+// the keys updated by a committed transaction
+type committedTX struct {
+	version uint64
+	writes  [][]byte  // sorted
+	bulk    *keyRange // the range of a bulk load, it's not recorded by keys
+}
+
+// Begin start a transaction
+func (db *KV) Begin() *KVTX {
+	return &KVTX{
+		db:       db,
+		snapshot: db.BeginRead(),
+		pending:  newPendingTree(),
+	}
+}
+
+// an in-memory B-tree for the pending updates
+func newPendingTree() BTree {
+	pages := map[uint64]BNode{}
+	next := uint64(0)
+	return BTree{
+		pageSize: BTREE_PAGE_SIZE, // it's enough for the keys of any page size
+		get: func(ptr uint64) BNode {
+			return pages[ptr]
+		},
+		new: func(node BNode) uint64 {
+			next++
+			pages[next] = node
+			return next
+		},
+		del: func(ptr uint64) {
+			delete(pages, ptr)
+		},
+	}
+}
+
+// Get read a key
+func (tx *KVTX) Get(key []byte) ([]byte, bool, error) {
+	if val, ok, _ := tx.pending.Get(key); ok {
+		// updated by this transaction
+		return val[1:], val[0] == FLAG_UPDATED, nil
+	}
+	key = bytes.Clone(key) // the caller can reuse the buffer
+	tx.reads = append(tx.reads, &keyRange{start: key, stop: key})
+	return tx.snapshot.Get(key)
+}
+
+// Seek return an iterator at the first key that is greater or equal to the key
+func (tx *KVTX) Seek(key []byte) KVIter {
+	return newTxIter(tx, key, +1)
+}
+
+// SeekLE return an iterator at the last key that is less or equal to the key
+func (tx *KVTX) SeekLE(key []byte) KVIter {
+	return newTxIter(tx, key, -1)
+}
+
+// Set update a key
+func (tx *KVTX) Set(key []byte, val []byte) error {
+	if tx.db.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := checkKey(key, tx.db.PageSize); err != nil {
+		return err
+	}
+	if len(val) > BTREE_MAX_VALUE_SIZE {
+		return ErrValueTooLarge
+	}
+	// the flag byte is not counted
+	return tx.pending.insert(key, append([]byte{FLAG_UPDATED}, val...))
+}
+
+// Delete remove a key
+func (tx *KVTX) Delete(key []byte) (bool, error) {
+	if tx.db.ReadOnly {
+		return false, ErrReadOnly
+	}
+	_, exists, err := tx.Get(key)
+	if err != nil || !exists {
+		return false, err
+	}
+	return true, tx.pending.insert(key, []byte{FLAG_DELETED})
+}
+
+// Commit apply the updates to the latest version and persist them
+func (tx *KVTX) Commit() error {
+	assert(!tx.done, "the transaction is done!")
+	tx.done = true
+	defer tx.snapshot.EndRead()
+
+	if tx.pending.root == 0 {
+		return nil // read-only transaction
+	}
+	if tx.db.ReadOnly {
+		return ErrReadOnly
+	}
+
+	version, err := commitPending(tx.db, tx)
+	if err != nil || tx.db.Sync != SYNC_GROUP {
+		return err
+	}
+	return groupSync(tx.db, version)
+}
+
+// apply the updates as the next version
+func commitPending(db *KV, tx *KVTX) (uint64, error) {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	if detectConflicts(db, tx) {
+		return 0, ErrConflict
+	}
+
+	saved := saveState(db)
+	writes, err := applyPending(db, tx)
+	if err == nil && db.WAL {
+		err = walCommit(db, tx)
+	}
+	if err != nil {
+		restoreState(db, saved)
+		return 0, err
+	}
+
+	return publishVersion(db, committedTX{writes: writes}), nil
+}
+
+// make the updated tree the next version, the writer lock is held
+func publishVersion(db *KV, committed committedTX) uint64 {
+	// new readers see the new version
+	db.mu.Lock()
+	db.version++
+	db.root = db.tree.root
+	oldest := db.version
+	for r := range db.readers {
+		oldest = min(oldest, r.version)
+	}
+	db.mu.Unlock()
+
+	// keep the history for the transactions that are still running
+	committed.version = db.version
+	db.history = append(db.history, committed)
+	trim := 0
+	for trim < len(db.history) && db.history[trim].version <= oldest {
+		trim++
+	}
+	db.history = slices.Clone(db.history[trim:])
+	return db.version
+}
+
+// wait until the version is durable. the first committer waits for
+// the others within the window, then syncs for all of them.
+func groupSync(db *KV, version uint64) error {
+	g := &db.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.synced < version && g.err == nil {
+		if g.leader {
+			g.cond.Wait()
+			continue
+		}
+		g.leader = true
+		g.mu.Unlock()
+		time.Sleep(db.SyncWindow)
+		db.writer.Lock()
+		err := groupFlush(db)
+		db.writer.Unlock()
+		g.mu.Lock()
+		g.leader = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	if g.synced >= version {
+		return nil
+	}
+	return g.err
+}
+
+// sync the committed versions, the writer lock is held
+func groupFlush(db *KV) error {
+	var err error
+	if db.WAL {
+		err = walSync(db)
+	} else {
+		err = checkpoint(db)
+	}
+	db.group.mu.Lock()
+	defer db.group.mu.Unlock()
+	if err != nil {
+		db.group.err = err
+	} else {
+		db.group.synced = db.version
+	}
+	return err
+}
+
+// apply the updates to the latest version and persist them
+func applyPending(db *KV, tx *KVTX) (writes [][]byte, err error) {
+	defer recoverPageError(&err)
+	for iter := tx.pending.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Key(), iter.Val()
+		switch val[0] {
+		case FLAG_DELETED:
+			_, err = db.tree.Delete(key)
+		case FLAG_BLOB:
+			db.tree.insertKV(key, val[1:], true)
+		default:
+			err = db.tree.Insert(key, val[1:])
+		}
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, key)
+	}
+	return writes, commitPages(db)
+}
+
+// persist the pages of a commit
+func commitPages(db *KV) error {
+	if err := writePages(db); err != nil {
+		return err
+	}
+	if db.deferred() {
+		resetPages(db) // the master page is updated by the checkpoints
+		return nil
+	}
+	return syncPages(db)
+}
+
+// Abort discard the updates, it's a no-op after the commit
+func (tx *KVTX) Abort() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.snapshot.EndRead()
+}
+
+// check the reads against the writes committed since the transaction began
+func detectConflicts(db *KV, tx *KVTX) bool {
+	for i := len(db.history) - 1; i >= 0; i-- {
+		committed := db.history[i]
+		if committed.version <= tx.snapshot.version {
+			break
+		}
+		for _, r := range tx.reads {
+			if rangeOverlaps(committed.writes, r) {
+				return true
+			}
+			if b := committed.bulk; b != nil && bytes.Compare(r.start, b.stop) <= 0 &&
+				(r.stop == nil || bytes.Compare(b.start, r.stop) <= 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether any of the sorted keys is within the range
+func rangeOverlaps(keys [][]byte, r *keyRange) bool {
+	idx, _ := slices.BinarySearchFunc(keys, r.start, bytes.Compare)
+	return idx < len(keys) && (r.stop == nil || bytes.Compare(keys[idx], r.stop) <= 0)
+}
+
+// the in-memory states of the writer, saved for the rollback
+type kvState struct {
+	root    uint64
+	head    uint64
+	flushed uint64
+	nfree   int
+	nappend int
+	updates map[uint64][]byte
+	pinned  []pinnedPages
+}
+
+func saveState(db *KV) kvState {
+	return kvState{
+		root:    db.tree.root,
+		head:    db.free.head,
+		flushed: db.page.flushed,
+		nfree:   db.page.nfree,
+		nappend: db.page.nappend,
+		updates: maps.Clone(db.page.updates),
+		pinned:  db.pinned,
+	}
+}
+
+func restoreState(db *KV, s kvState) {
+	db.tree.root = s.root
+	db.free.head = s.head
+	db.page.flushed = s.flushed
+	db.page.nfree = s.nfree
+	db.page.nappend = s.nappend
+	db.page.updates = s.updates
+	db.pinned = s.pinned
+	unlockReaders(db) // the releases of the pinned pages are undone
+}
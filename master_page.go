@@ -5,58 +5,173 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 )
 
-const DB_SIG = "TINYDB_SIG"
+const DB_SIG = "TINYDB_SIG4" // changed by the key prefixes, the page size and the flags
+
+const (
+	MASTER_SLOT_SIZE = 512 // a sector, so that a slot is not torn by a single write
+	MASTER_SIZE      = 60
+)
+
+// the flags of the master page
+const (
+	MASTER_CLEAN = 1 // closed without leaking pages, see masterClose
+)
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B | 8B 		  | 8B        |
+// there are 2 slots in the master page and they are updated alternately,
+// so a torn write leaves the previous version in the other slot.
+// | sig | seq | btree_root | page_used | free_list | page_size | flags | crc32 |
+// | 16B | 8B  | 8B         | 8B        | 8B        | 4B        | 4B    | 4B    |
 func masterLoad(db *KV) error {
 	if db.mmap.file == 0 {
+		if db.ReadOnly {
+			return errors.New("empty file")
+		}
 		// empty file, the master page will be created on the first write
+		if db.PageSize == 0 {
+			db.PageSize = BTREE_PAGE_SIZE
+		}
 		db.page.flushed = 1 // reserved for the master page
 		return nil
 	}
 
 	data := db.mmap.chunks[0]
-	root := binary.LittleEndian.Uint64(data[16:])
-	used := binary.LittleEndian.Uint64(data[24:])
-	freeList := binary.LittleEndian.Uint64(data[32:])
-
-	sig := make([]byte, 16)
-	copy(sig[:], []byte(DB_SIG))
-	//verify the page
-	if !bytes.Equal(sig, data[:16]) {
-		return errors.New("bad signature")
+	if db.ReadOnly {
+		// a writer can extend the file after it's mapped, it's done
+		// before the master page points to the new pages. so the size
+		// is taken after the master page is read.
+		data = bytes.Clone(data[:2*MASTER_SLOT_SIZE])
+		fi, err := db.fp.Stat()
+		if err != nil {
+			return fmt.Errorf("stat: %w", err)
+		}
+		db.mmap.file = min(int(fi.Size()), db.mmap.total)
+	}
+	var slots [2]*masterSlot
+	for i := range slots {
+		slots[i] = masterDecode(db, data[i*MASTER_SLOT_SIZE:][:MASTER_SIZE])
 	}
 
-	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
-	bad = bad || !(0 <= root && root < (used+freeList))
-	if bad {
+	// use the newest valid slot
+	m := slots[0]
+	if m == nil || (slots[1] != nil && slots[1].seq > m.seq) {
+		m = slots[1]
+	}
+	if m == nil {
 		return errors.New("bad master page")
 	}
+	if db.PageSize != 0 && db.PageSize != m.pageSize {
+		return fmt.Errorf("%w: %d, the file uses %d", ErrPageSize, db.PageSize, m.pageSize)
+	}
+	db.PageSize = m.pageSize
 
-	db.tree.root = root
-	db.page.flushed = used
-	db.free.head = freeList
+	db.master.seq = m.seq
+	db.master.clean = m.clean
+	db.tree.root = m.root
+	db.page.flushed = m.used
+	db.free.head = m.freeList
 	return nil
 }
 
-// update the master page. it must be atomic
-func materStore(db *KV) error {
-	var data [40]byte
-	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
-	binary.LittleEndian.PutUint64(data[32:], db.free.head)
+type masterSlot struct {
+	seq      uint64
+	root     uint64
+	used     uint64
+	freeList uint64
+	pageSize int
+	clean    bool
+}
+
+// decode & verify a slot, nil if it's torn or invalid
+func masterDecode(db *KV, data []byte) *masterSlot {
+	if !bytes.Equal(data[:16], masterSig()) {
+		return nil
+	}
+	if crc32.ChecksumIEEE(data[:56]) != binary.LittleEndian.Uint32(data[56:]) {
+		db.Logger.Printf("tinydb: %s: a torn master page write is discarded", db.Path)
+		return nil
+	}
+	m := &masterSlot{
+		seq:      binary.LittleEndian.Uint64(data[16:]),
+		root:     binary.LittleEndian.Uint64(data[24:]),
+		used:     binary.LittleEndian.Uint64(data[32:]),
+		freeList: binary.LittleEndian.Uint64(data[40:]),
+		pageSize: int(binary.LittleEndian.Uint32(data[48:])),
+		clean:    binary.LittleEndian.Uint32(data[52:])&MASTER_CLEAN != 0,
+	}
+	if !masterCheck(db, m) {
+		return nil
+	}
+	return m
+}
+
+func masterCheck(db *KV, m *masterSlot) bool {
+	if checkPageSize(m.pageSize) != nil || db.mmap.file%m.pageSize != 0 {
+		return false
+	}
+	bad := !(1 <= m.used && m.used <= uint64(db.mmap.file/m.pageSize))
+	bad = bad || !(m.root < m.used && m.freeList < m.used)
+	return !bad
+}
+
+func masterSig() []byte {
+	sig := make([]byte, 16)
+	copy(sig, DB_SIG)
+	return sig
+}
+
+// update the master page, it must be atomic.
+// the slot of the older version is overwritten.
+func masterStore(db *KV, clean bool) error {
+	seq := db.master.seq + 1
+	data := masterEncode(&masterSlot{
+		seq:      seq,
+		root:     db.tree.root,
+		used:     db.page.flushed,
+		freeList: db.free.head,
+		pageSize: db.PageSize,
+		clean:    clean,
+	})
 
 	// NOTE: Updating the page via mmap is not atomic.
 	// 		 Use the `pwrite()` syscall instead
-	_, err := db.fp.WriteAt(data[:], 0)
+	_, err := db.fp.WriteAt(data, int64(seq%2)*MASTER_SLOT_SIZE)
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
+	db.master.seq = seq
+	db.master.clean = clean
 	return nil
 }
+
+func masterEncode(m *masterSlot) []byte {
+	data := make([]byte, MASTER_SIZE)
+	copy(data[:16], DB_SIG)
+	binary.LittleEndian.PutUint64(data[16:], m.seq)
+	binary.LittleEndian.PutUint64(data[24:], m.root)
+	binary.LittleEndian.PutUint64(data[32:], m.used)
+	binary.LittleEndian.PutUint64(data[40:], m.freeList)
+	binary.LittleEndian.PutUint32(data[48:], uint32(m.pageSize))
+	if m.clean {
+		binary.LittleEndian.PutUint32(data[52:], MASTER_CLEAN)
+	}
+	binary.LittleEndian.PutUint32(data[56:], crc32.ChecksumIEEE(data[:56]))
+	return data
+}
+
+// mark the file as closed cleanly, the next Open doesn't look for the
+// leaked pages. it's skipped if any page is not in the free list.
+func masterClose(db *KV) error {
+	if db.master.clean || db.page.leaked || len(db.pinned) > 0 || db.page.reserved > 0 {
+		return nil
+	}
+	// the pages are made durable by the last masterSync
+	if err := masterStore(db, true); err != nil {
+		return fmt.Errorf("masterstore: %w", err)
+	}
+	return dbSync(db)
+}
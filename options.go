@@ -0,0 +1,100 @@
+package tinydb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+type SyncMode int
+
+// when the updates are made durable
+const (
+	SYNC_FULL = SyncMode(0) // fsync on every commit
+	SYNC_NONE = SyncMode(1) // leave it to the OS, a crash can lose the recent commits
+	// the concurrent commits share an fsync, a commit returns once it's
+	// durable. the readers can see a commit before that.
+	SYNC_GROUP = SyncMode(2)
+)
+
+// Options of opening a database, the zero value is the defaults.
+type Options struct {
+	// open an existing file without creating or writing to it,
+	// the updates fail with ErrReadOnly. it can be opened while another
+	// process writes it, it sees the version when it's opened, or the
+	// last checkpoint in the WAL mode. the writer doesn't reuse the
+	// freed pages until the read-only opens are closed, see lockOpen.
+	ReadOnly bool
+	Sync     SyncMode
+	// how long the group commit waits for more commits before the sync
+	SyncWindow time.Duration
+	// log the commits to the write-ahead log instead of flushing the
+	// pages, the log is replayed after a crash, see wal.go.
+	WAL bool
+	// the log size that triggers a checkpoint, 0 for 4MB
+	CheckpointSize int
+	// the page size of a new file, 0 for BTREE_PAGE_SIZE.
+	// an existing file is opened with its own size if it's 0.
+	PageSize int
+	// the initial mmap size, it's doubled when the file outgrows it.
+	// 0 for 64MB, it must be a multiple of BTREE_PAGE_SIZE_MAX.
+	MmapSize int
+	// the limit of the mmap size, thus the file size, 0 for no limit.
+	// the pages are cached by the OS through the mmap.
+	MaxMmapSize int
+	// the minimum number of bytes the file is extended by,
+	// 0 to extend it by 1/8 of its size.
+	FileGrowth int
+	// the permission of a new file, 0 for 0644
+	FileMode os.FileMode
+	// how long to wait for the file lock held by another writer,
+	// 0 to fail with ErrLocked immediately. it's not used by ReadOnly.
+	LockTimeout time.Duration
+	// for the errors that can't be returned, nil to discard them
+	Logger *log.Logger
+}
+
+// validate the options and fill in the defaults
+func optionsCheck(opts *Options) error {
+	if opts.Sync != SYNC_FULL && opts.Sync != SYNC_NONE && opts.Sync != SYNC_GROUP {
+		return fmt.Errorf("tinydb: bad sync mode %d", opts.Sync)
+	}
+	if opts.SyncWindow < 0 {
+		return fmt.Errorf("tinydb: bad sync window %v", opts.SyncWindow)
+	}
+	if opts.CheckpointSize == 0 {
+		opts.CheckpointSize = WAL_CHECKPOINT_SIZE
+	}
+	if opts.CheckpointSize < 0 {
+		return fmt.Errorf("tinydb: bad checkpoint size %d", opts.CheckpointSize)
+	}
+	if opts.PageSize != 0 {
+		if err := checkPageSize(opts.PageSize); err != nil {
+			return err
+		}
+	}
+	if opts.MmapSize == 0 {
+		opts.MmapSize = 64 << 20
+	}
+	if opts.MmapSize < 0 || opts.MmapSize%BTREE_PAGE_SIZE_MAX != 0 {
+		return fmt.Errorf("tinydb: bad mmap size %d", opts.MmapSize)
+	}
+	if opts.MaxMmapSize < 0 || (opts.MaxMmapSize > 0 && opts.MaxMmapSize < opts.MmapSize) {
+		return fmt.Errorf("tinydb: bad max mmap size %d", opts.MaxMmapSize)
+	}
+	if opts.FileGrowth < 0 {
+		return fmt.Errorf("tinydb: bad file growth %d", opts.FileGrowth)
+	}
+	if opts.LockTimeout < 0 {
+		return fmt.Errorf("tinydb: bad lock timeout %v", opts.LockTimeout)
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = 0644
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+	return nil
+}
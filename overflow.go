@@ -0,0 +1,81 @@
+package tinydb
+
+import "encoding/binary"
+
+const (
+	BNODE_OVERFLOW  = 4
+	OVERFLOW_HEADER = 4 + 8 // type(2B) + size(2B) + next(8B)
+	OVERFLOW_STUB   = 8 + 8 // total(8B) + head(8B)
+)
+
+// the data size of an overflow page
+func overflowCap(pageSize int) int {
+	return nodeSize(pageSize) - OVERFLOW_HEADER
+}
+
+// values larger than maxInlineSize are stored in a chain of
+// overflow pages, the leaf stores a stub pointing to the chain instead.
+// the page format:
+// | type | size | next | data      |
+// | 2B   | 2B   | 8B   | size * 1B |
+// the stub format:
+// | total | head |
+// | 8B    | 8B   |
+
+// write the value into a new chain, return the stub
+func overflowWrite(tree *BTree, val []byte) []byte {
+	// from the tail, so that a page can link to the next one
+	next := uint64(0)
+	capacity := overflowCap(tree.pageSize)
+	for end := len(val); end > 0; {
+		begin := (end - 1) / capacity * capacity
+		node := NewBNode(make([]byte, tree.pageSize))
+		binary.LittleEndian.PutUint16(node.data[0:], BNODE_OVERFLOW)
+		binary.LittleEndian.PutUint16(node.data[2:], uint16(end-begin))
+		binary.LittleEndian.PutUint64(node.data[4:], next)
+		copy(node.data[OVERFLOW_HEADER:], val[begin:end])
+		next = tree.new(node)
+		end = begin
+	}
+
+	stub := make([]byte, OVERFLOW_STUB)
+	binary.LittleEndian.PutUint64(stub[0:], uint64(len(val)))
+	binary.LittleEndian.PutUint64(stub[8:], next)
+	return stub
+}
+
+// reassemble the value from the chain
+func overflowRead(tree *BTree, stub []byte) []byte {
+	total := binary.LittleEndian.Uint64(stub[0:])
+	val := make([]byte, 0, total)
+	for ptr := binary.LittleEndian.Uint64(stub[8:]); ptr != 0; {
+		node := overflowGet(tree, ptr)
+		val = append(val, node.data[OVERFLOW_HEADER:][:overflowSize(node)]...)
+		ptr = binary.LittleEndian.Uint64(node.data[4:])
+	}
+	if uint64(len(val)) != total {
+		panic(ErrCorrupted)
+	}
+	return val
+}
+
+func overflowSize(node BNode) int {
+	return int(binary.LittleEndian.Uint16(node.data[2:]))
+}
+
+// deallocate the chain
+func overflowFree(tree *BTree, stub []byte) {
+	for ptr := binary.LittleEndian.Uint64(stub[8:]); ptr != 0; {
+		next := binary.LittleEndian.Uint64(overflowGet(tree, ptr).data[4:])
+		tree.del(ptr)
+		ptr = next
+	}
+}
+
+func overflowGet(tree *BTree, ptr uint64) BNode {
+	node := tree.get(ptr)
+	if node.btype() != BNODE_OVERFLOW || overflowSize(node) > overflowCap(tree.pageSize) {
+		panic(ErrCorrupted)
+	}
+	return node
+}
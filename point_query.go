@@ -7,30 +7,42 @@ import (
 )
 
 // get a single row by the primary key
-func dbGet(db *DB, tdef *TableDef, rec *Record) (bool, error) {
+func dbGet(tx *DBTX, tdef *TableDef, rec *Record) (bool, error) {
 	values, err := checkRecord(tdef, *rec, tdef.PKeys)
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
-	val, ok := db.kv.Get(key)
-	if !ok {
-		return false, nil
-	}
-
-	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
-		values[i].Type = tdef.Types[i]
+	val, ok, err := tx.kv.Get(key)
+	if err != nil || !ok {
+		return false, err
 	}
 
-	values = decodeValues(val, values[tdef.PKeys:])
+	values = decodeRow(tdef, values[:tdef.PKeys], val)
 
 	rec.Cols = append(rec.Cols, tdef.Cols[tdef.PKeys:]...)
-	rec.Vals = append(rec.Vals, values...)
+	rec.Vals = append(rec.Vals, values[tdef.PKeys:]...)
 
 	return true, nil
 }
 
+// decode a row from its primary key and the encoded value
+func decodeRow(tdef *TableDef, pkeys []Value, val []byte) []Value {
+	values := make([]Value, len(tdef.Cols))
+	copy(values, pkeys)
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		values[i].Type = tdef.Types[i]
+	}
+	copy(values[tdef.PKeys:], decodeValues(val, values[tdef.PKeys:]))
+	for i := tdef.PKeys; i < len(tdef.Cols); i++ {
+		if tdef.Types[i] == TYPE_BLOB {
+			values[i].Str = nil // the reference, use OpenBlob to read it
+		}
+	}
+	return values
+}
+
 // for primary key
 func encodeKey(out []byte, prefix uint32, vals []Value) []byte {
 	var buf [4]byte
@@ -48,7 +60,7 @@ func encodeValues(out []byte, vals []Value) []byte {
 			u := uint64(v.I64) + (1 << 63)
 			binary.BigEndian.PutUint64(buf[:], u)
 			out = append(out, buf[:]...)
-		case TYPE_BYTES:
+		case TYPE_BYTES, TYPE_BLOB:
 			out = append(out, escapeString(v.Str)...)
 			out = append(out, 0) // null-terminated
 		default:
@@ -63,7 +75,7 @@ func decodeValues(in []byte, out []Value) []Value {
 	var result []Value
 	for _, valDef := range out {
 		switch valDef.Type {
-		case TYPE_BYTES:
+		case TYPE_BYTES, TYPE_BLOB:
 			nullTerm := cur
 			for nullTerm < len(in) && in[nullTerm] != 0 {
 				nullTerm++
@@ -136,6 +148,9 @@ func escapeString(in []byte) []byte {
 // n == tdef.PKeys: record is exactly a primary key
 // n == len(tdef.Cols): record contains all columns
 func checkRecord(tdef *TableDef, record Record, n int) ([]Value, error) {
+	if len(record.Cols) < n {
+		return nil, fmt.Errorf("tinydb: missing columns")
+	}
 	reorderedRec := make([]Value, len(tdef.Cols))
 	cols := tdef.Cols[:n]
 	for i := range n {
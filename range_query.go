@@ -0,0 +1,207 @@
+package tinydb
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// comparison operators of range queries
+const (
+	CMP_GE = +3 // >=
+	CMP_GT = +2 // >
+	CMP_LT = -2 // <
+	CMP_LE = -3 // <=
+)
+
+// Scanner the iterator for range queries.
+// the range is from Key1 to Key2, it's descending if Cmp1 is `<` or `<=`.
+// the keys are prefixes of the primary key or a secondary index.
+type Scanner struct {
+	Cmp1 int
+	Cmp2 int
+	Key1 Record
+	Key2 Record
+	// internal
+	tx    *DBTX
+	tdef  *TableDef
+	index int    // -1: use the primary key; >= 0: use an index
+	iter  KVIter // the underlying KV iterator
+	desc  bool   // the scan direction
+	owned bool   // the scanner ends the transaction
+	done  bool   // the transaction is ended
+	// the encoded range: [lo, hi), nil denotes no bound
+	lo []byte
+	hi []byte
+}
+
+// Valid within the range or not
+func (sc *Scanner) Valid() bool {
+	if sc.done {
+		return false
+	}
+	valid := sc.iter.Valid()
+	if valid {
+		key := sc.iter.Key()
+		if sc.desc {
+			valid = sc.lo == nil || bytes.Compare(key, sc.lo) >= 0
+		} else {
+			valid = sc.hi == nil || bytes.Compare(key, sc.hi) < 0
+		}
+	}
+	if !valid {
+		sc.Close()
+	}
+	return valid
+}
+
+// Err return the error that stopped the scan early, e.g. ErrCorrupted
+func (sc *Scanner) Err() error {
+	return sc.iter.Err()
+}
+
+// Close end the transaction started by DB.Scan, it's a no-op otherwise.
+// this is only needed if the scanner isn't exhausted.
+func (sc *Scanner) Close() {
+	if sc.owned && !sc.done {
+		sc.done = true
+		sc.tx.Abort()
+	}
+}
+
+// Next move the underlying B-tree iterator
+func (sc *Scanner) Next() {
+	assert(sc.Valid(), "scanner is not valid!")
+	if sc.desc {
+		sc.iter.Prev()
+	} else {
+		sc.iter.Next()
+	}
+}
+
+// Deref fetch the current row
+func (sc *Scanner) Deref(rec *Record) error {
+	assert(sc.Valid(), "scanner is not valid!")
+	tdef := sc.tdef
+
+	// decode the primary key from the B-tree key
+	icols := indexCols(tdef, sc.index)
+	ivals := make([]Value, len(icols))
+	for i, col := range icols {
+		ivals[i].Type = tdef.Types[slices.Index(tdef.Cols, col)]
+	}
+	ivals = decodeValues(sc.iter.Key()[4:], ivals)
+	pkeys := make([]Value, tdef.PKeys)
+	for i, col := range tdef.Cols[:tdef.PKeys] {
+		pkeys[i] = ivals[slices.Index(icols, col)]
+	}
+
+	// fetch the row
+	val := sc.iter.Val()
+	if err := sc.iter.Err(); err != nil {
+		return err
+	}
+	if sc.index >= 0 {
+		var ok bool
+		var err error
+		val, ok, err = sc.tx.kv.Get(encodeKey(nil, tdef.Prefix, pkeys))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: table %s: missing row of the index %v", ErrCorrupted, tdef.Name, tdef.Indexes[sc.index])
+		}
+	}
+	values := decodeRow(tdef, pkeys, val)
+
+	rec.Cols = append(rec.Cols[:0], tdef.Cols...)
+	rec.Vals = append(rec.Vals[:0], values...)
+	return nil
+}
+
+// range query on the primary key or a secondary index
+func dbScan(tx *DBTX, tdef *TableDef, req *Scanner) error {
+	// sanity checks
+	if !isCmp(req.Cmp1) || !isCmp(req.Cmp2) || (req.Cmp1 > 0) == (req.Cmp2 > 0) {
+		return fmt.Errorf("tinydb: bad range: %d %d", req.Cmp1, req.Cmp2)
+	}
+
+	// select an index by the columns
+	index := findIndex(tdef, req.Key1.Cols, req.Key2.Cols)
+	if index < -1 {
+		return fmt.Errorf("tinydb: no index for the range")
+	}
+	values1, err := checkIndexKey(tdef, index, req.Key1)
+	if err != nil {
+		return err
+	}
+	values2, err := checkIndexKey(tdef, index, req.Key2)
+	if err != nil {
+		return err
+	}
+
+	req.tx, req.tdef, req.index = tx, tdef, index
+	prefix := tdef.Prefix
+	if index >= 0 {
+		prefix = tdef.IndexPrefixes[index]
+	}
+	key1 := encodeKey(nil, prefix, values1)
+	key2 := encodeKey(nil, prefix, values2)
+	req.desc = req.Cmp1 < 0
+	if req.desc {
+		req.lo, req.hi = encodeBound(key2, req.Cmp2), encodeBound(key1, req.Cmp1)
+	} else {
+		req.lo, req.hi = encodeBound(key1, req.Cmp1), encodeBound(key2, req.Cmp2)
+	}
+
+	// seek to the start key
+	if !req.desc {
+		req.iter = tx.kv.Seek(req.lo)
+		return req.iter.Err()
+	}
+	if req.hi == nil {
+		// no upper bound, start from the last key
+		req.iter = tx.kv.SeekLE(bytes.Repeat([]byte{0xff}, BTREE_PAGE_MAX_KEY_SIZE))
+	} else {
+		req.iter = tx.kv.SeekLE(req.hi)
+		if req.iter.Valid() && bytes.Equal(req.iter.Key(), req.hi) {
+			req.iter.Prev()
+		}
+	}
+	return req.iter.Err()
+}
+
+func isCmp(cmp int) bool {
+	switch cmp {
+	case CMP_GE, CMP_GT, CMP_LT, CMP_LE:
+		return true
+	}
+	return false
+}
+
+// convert a key prefix and its comparison operator into a bound of [lo, hi).
+// the key is a prefix of all the keys it covers, thus:
+// `>= key` and `< key` bound at the key itself,
+// `> key` and `<= key` bound at the first key after the covered keys.
+func encodeBound(key []byte, cmp int) []byte {
+	switch cmp {
+	case CMP_GE, CMP_LT:
+		return key
+	case CMP_GT, CMP_LE:
+		return prefixSuccessor(key)
+	}
+	panic("bad cmp")
+}
+
+// the smallest key that is greater than all keys prefixed by the input.
+// returns nil if there is none.
+func prefixSuccessor(prefix []byte) []byte {
+	out := bytes.Clone(prefix)
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] < 0xff {
+			out[i]++
+			return out[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Stats the storage statistics, see KV.Stats
+type Stats struct {
+	// the tree of the latest version
+	Height        int // the number of levels, 0 for an empty tree
+	InternalPages int
+	LeafPages     int
+	OverflowPages int
+	Keys          int     // the dummy key is not counted
+	FillFactor    float64 // the average usage of the internal and leaf pages
+	// the file
+	PageSize   int
+	Pages      uint64 // the pages in use, including the free ones
+	FreePages  uint64 // the length of the free list
+	FileSize   int64  // it can be larger than the pages, see Options.FileGrowth
+	MmapSize   int
+	MmapChunks int
+}
+
+// Stats collect the storage statistics.
+// the tree is walked on a snapshot without blocking the writers.
+func (db *KV) Stats() (Stats, error) {
+	var s Stats
+	db.writer.Lock()
+	s.PageSize = db.PageSize
+	s.Pages = db.page.flushed
+	s.FileSize = int64(db.mmap.file)
+	s.MmapSize = db.mmap.total
+	s.MmapChunks = len(db.mmap.chunks)
+	err := statsFreeList(db, &s)
+	db.writer.Unlock()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	r := db.BeginRead()
+	defer r.EndRead()
+	if err := statsTree(&r.tree, &s); err != nil {
+		return Stats{}, err
+	}
+	return s, nil
+}
+
+func statsFreeList(db *KV, s *Stats) (err error) {
+	defer recoverPageError(&err)
+	if db.free.head != 0 {
+		// the pointers taken from the list before the checkpoint, see KV.deferred
+		s.FreePages = db.free.Total() - uint64(db.page.nfree)
+	}
+	return nil
+}
+
+func statsTree(tree *BTree, s *Stats) (err error) {
+	defer recoverPageError(&err)
+	if tree.root == 0 {
+		return nil
+	}
+	used := statsNode(tree, tree.root, 1, s)
+	s.Keys-- // the dummy key
+	pages := s.InternalPages + s.LeafPages
+	s.FillFactor = float64(used) / float64(pages*nodeSize(tree.pageSize))
+	return nil
+}
+
+// count the pages of the subtree and return the bytes used by them
+func statsNode(tree *BTree, ptr uint64, depth int, s *Stats) int {
+	node := tree.get(ptr)
+	used := int(node.nbytes())
+	if node.btype() == BNODE_LEAF {
+		s.LeafPages++
+		s.Keys += int(node.nkeys())
+		s.Height = max(s.Height, depth)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if node.isOverflow(i) {
+				// counted by the size instead of reading the chain
+				size := int(binary.LittleEndian.Uint64(node.getVal(i)[0:]))
+				s.OverflowPages += (size + overflowCap(tree.pageSize) - 1) / overflowCap(tree.pageSize)
+			}
+		}
+		return used
+	}
+	s.InternalPages++
+	for i := uint16(0); i < node.nkeys(); i++ {
+		used += statsNode(tree, node.getPtr(i), depth+1, s)
+	}
+	return used
+}
+
+// TableStats the storage usage of a table, the bytes are of the keys and values
+type TableStats struct {
+	Rows       int
+	RowBytes   int64
+	IndexBytes int64 // the keys of the secondary indexes
+	BlobBytes  int64 // the blob columns stored apart from the rows
+}
+
+// TableStats scan the keys of the table for its storage usage
+func (db *DB) TableStats(table string) (TableStats, error) {
+	tx := db.Begin()
+	defer tx.Abort()
+	tdef, err := getTableDef(tx, table)
+	if err != nil {
+		return TableStats{}, err
+	}
+
+	var s TableStats
+	r := tx.kv.snapshot
+	s.Rows, s.RowBytes, err = statsPrefix(r, encodeKey(nil, tdef.Prefix, nil))
+	if err != nil {
+		return TableStats{}, err
+	}
+	for _, prefix := range tdef.IndexPrefixes {
+		_, size, err := statsPrefix(r, encodeKey(nil, prefix, nil))
+		if err != nil {
+			return TableStats{}, err
+		}
+		s.IndexBytes += size
+	}
+	key := binary.BigEndian.AppendUint32(nil, BLOB_PREFIX)
+	_, s.BlobBytes, err = statsPrefix(r, binary.BigEndian.AppendUint32(key, tdef.Prefix))
+	if err != nil {
+		return TableStats{}, err
+	}
+	return s, nil
+}
+
+// the number of the keys with the prefix and the size of the KVs
+func statsPrefix(r *KVReader, prefix []byte) (int, int64, error) {
+	count, size := 0, int64(0)
+	iter := r.Seek(prefix)
+	for ; iter.Valid() && bytes.HasPrefix(iter.Key(), prefix); iter.Next() {
+		count++
+		size += int64(len(iter.Key())) + iter.valSize()
+	}
+	return count, size, iter.Err()
+}
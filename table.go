@@ -4,8 +4,12 @@ const (
 	TYPE_ERROR = 0
 	TYPE_BYTES = 1
 	TYPE_INT64 = 2
+	TYPE_BLOB  = 3 // stored separately, see blobKey
 )
 
+// the key prefix of the blob columns
+const BLOB_PREFIX = 3
+
 // TDEF_META internal table: metadata
 var TDEF_META = &TableDef{
 	Prefix: 1,
@@ -44,8 +48,12 @@ type TableDef struct {
 	Types []uint32 // column types
 	Cols  []string // column names
 	PKeys int      // the first `PKeys` columns are the primary key
+	// secondary indexes, each is a list of column names.
+	// the primary key columns are appended to make the index keys unique.
+	Indexes [][]string
 	// auto-assigned  B-tree key prefixes for different table
-	Prefix uint32
+	Prefix        uint32
+	IndexPrefixes []uint32
 }
 
 func (rec *Record) AddStr(key string, val []byte) *Record {
@@ -57,6 +65,16 @@ func (rec *Record) AddStr(key string, val []byte) *Record {
 	return rec
 }
 
+// AddBlob add a blob column, nil keeps the existing blob when updating
+func (rec *Record) AddBlob(key string, val []byte) *Record {
+	rec.Cols = append(rec.Cols, key)
+	rec.Vals = append(rec.Vals, Value{
+		Type: TYPE_BLOB,
+		Str:  val,
+	})
+	return rec
+}
+
 func (rec *Record) AddInt64(key string, val int64) *Record {
 	rec.Cols = append(rec.Cols, key)
 	rec.Vals = append(rec.Vals, Value{
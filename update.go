@@ -1,6 +1,9 @@
 package tinydb
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type UpdateMode int
 
@@ -12,43 +15,80 @@ const (
 )
 
 func Update(db *KV, key, val []byte, mode UpdateMode) (bool, error) {
-	switch mode {
-	case MODE_UPSERT:
-		err := db.Set(key, val)
+	for {
+		tx := db.Begin()
+		_, exists, err := tx.Get(key)
+		if err == nil {
+			err = checkUpdateMode(key, exists, mode)
+		}
 		if err != nil {
+			tx.Abort()
 			return false, err
 		}
-		return true, nil
-	case MODE_UPDATE_ONLY:
-		if _, ok := db.Get(key); !ok {
-			return false, fmt.Errorf("the key %s does not exist", key)
-		}
-		err := db.Set(key, val)
-		if err != nil {
+		if err := tx.Set(key, val); err != nil {
+			tx.Abort()
 			return false, err
 		}
-		return true, nil
-	case MODE_INSERT_ONLY:
-		if _, ok := db.Get(key); ok {
-			return false, fmt.Errorf("the key %s exists", key)
+		err = tx.Commit()
+		if err == nil {
+			return true, nil
 		}
-		err := db.Set(key, val)
-		if err != nil {
+		if !errors.Is(err, ErrConflict) {
 			return false, err
 		}
-		return true, nil
 	}
-	return false, fmt.Errorf("unknown mode %d", mode)
+}
+
+// check whether the update is allowed by the mode
+func checkUpdateMode(key []byte, exists bool, mode UpdateMode) error {
+	switch mode {
+	case MODE_UPSERT:
+		return nil
+	case MODE_UPDATE_ONLY:
+		if !exists {
+			return fmt.Errorf("the key %s does not exist", key)
+		}
+		return nil
+	case MODE_INSERT_ONLY:
+		if exists {
+			return fmt.Errorf("the key %s exists", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown mode %d", mode)
 }
 
 // add a row to the table
-func dbUpdate(db *DB, tdef *TableDef, rec Record, mode UpdateMode) (bool, error) {
+func dbUpdate(tx *DBTX, tdef *TableDef, rec Record, mode UpdateMode) (bool, error) {
 	values, err := checkRecord(tdef, rec, len(tdef.Cols))
 	if err != nil {
 		return false, err
 	}
 
 	key := encodeKey(nil, tdef.Prefix, values[:tdef.PKeys])
+
+	// the old row is needed to remove its index keys
+	old, exists, err := tx.kv.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if err := checkUpdateMode(key, exists, mode); err != nil {
+		return false, err
+	}
+
+	// the row and its index keys are updated in a single transaction
+	if exists && len(tdef.Indexes) > 0 {
+		err := indexOp(tx.kv, tdef, decodeRow(tdef, values[:tdef.PKeys], old), INDEX_DEL)
+		if err != nil {
+			return false, err
+		}
+	}
+	if err := blobUpdate(tx, tdef, values); err != nil {
+		return false, err
+	}
 	val := encodeValues(nil, values[tdef.PKeys:])
-	return Update(db.kv, key, val, mode)
+	if err := tx.kv.Set(key, val); err != nil {
+		return false, err
+	}
+	return true, indexOp(tx.kv, tdef, values, INDEX_ADD)
 }
@@ -0,0 +1,275 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// the owners of the pages, see KV.Verify
+const (
+	PAGE_UNUSED = iota
+	PAGE_MASTER
+	PAGE_TREE
+	PAGE_OVERFLOW
+	PAGE_FREE_LIST // the nodes of the free list
+	PAGE_FREE      // the pointers in the free list
+	PAGE_PINNED    // freed but still visible to the readers
+)
+
+var pageOwners = []string{"unused", "master", "tree", "overflow", "free list", "free", "pinned"}
+
+// the number of the problems reported by KV.Verify
+const VERIFY_MAX_ERRORS = 100
+
+// Verify check the database like fsck. it walks the B-tree and the free
+// list, and checks that every page is used exactly once. the problems
+// found are joined, they wrap ErrCorrupted or ErrBadPointer.
+// the pages used by nothing wrap ErrLeaked instead, they are not damage:
+// the pages reserved by an unfinished BlobWriter, and the pages pinned
+// by the last commits before a crash if the file is opened read-only,
+// as a writer reclaims them when it opens the file.
+// the free list is updated in place by a writer in another process,
+// so Verify of a read-only open is only accurate without a writer.
+func (db *KV) Verify() error {
+	db.writer.Lock()
+	defer db.writer.Unlock()
+
+	// every page is either used or free
+	v := verifyPages(db)
+	leaked, first := 0, uint64(0)
+	for ptr, owner := range v.owners {
+		if owner == PAGE_UNUSED {
+			if leaked == 0 {
+				first = uint64(ptr)
+			}
+			leaked++
+		}
+	}
+	if leaked > 0 {
+		v.fail(fmt.Errorf("%w: %d pages are leaked, the first one is %d", ErrLeaked, leaked, first))
+	}
+	return errors.Join(v.errs...)
+}
+
+// find the owners of the pages, the writer lock is held
+func verifyPages(db *KV) *verifier {
+	v := &verifier{db: db, owners: make([]byte, db.page.flushed), depth: -1}
+	v.owners[0] = PAGE_MASTER
+	if db.tree.root != 0 {
+		v.tree(db.tree.root, nil, nil, 0)
+	}
+	v.freeList()
+	for _, p := range db.pinned {
+		for _, ptr := range p.ptrs {
+			v.use(ptr, PAGE_PINNED)
+		}
+	}
+	return v
+}
+
+type verifier struct {
+	db     *KV
+	owners []byte // the owner of each page
+	depth  int    // the depth of the leaves
+	errs   []error
+}
+
+func (v *verifier) fail(err error) {
+	if len(v.errs) < VERIFY_MAX_ERRORS {
+		v.errs = append(v.errs, err)
+	}
+}
+
+func (v *verifier) failPage(ptr uint64, format string, args ...any) {
+	v.fail(&PageError{Page: ptr, Err: fmt.Errorf("%w: "+format, append([]any{ErrCorrupted}, args...)...)})
+}
+
+// mark the page as used by the owner, false if it's not usable
+func (v *verifier) use(ptr uint64, owner byte) bool {
+	if ptr == 0 || ptr >= uint64(len(v.owners)) {
+		v.fail(&PageError{Page: ptr, Err: ErrBadPointer})
+		return false
+	}
+	if v.owners[ptr] != PAGE_UNUSED {
+		v.failPage(ptr, "used as %s and %s", pageOwners[v.owners[ptr]], pageOwners[owner])
+		return false
+	}
+	v.owners[ptr] = owner
+	return true
+}
+
+// read a page and verify the checksum
+func (v *verifier) page(ptr uint64) (node BNode, err error) {
+	defer recoverPageError(&err)
+	return v.db.pageGetMapped(ptr), nil
+}
+
+// check the subtree, its keys are within [first, stop).
+// the first key must be equal to the key linking to the node.
+func (v *verifier) tree(ptr uint64, first, stop []byte, depth int) {
+	if !v.use(ptr, PAGE_TREE) {
+		return
+	}
+	node, err := v.page(ptr)
+	if err != nil {
+		v.fail(err)
+		return
+	}
+	if err := nodeCheck(node, v.db.PageSize); err != nil {
+		v.fail(&PageError{Page: ptr, Err: err})
+		return
+	}
+	if node.btype() == BNODE_LEAF {
+		if v.depth < 0 {
+			v.depth = depth
+		} else if v.depth != depth {
+			v.failPage(ptr, "the leaf is at depth %d, others at %d", depth, v.depth)
+		}
+	}
+
+	nkeys := node.nkeys()
+	keys := make([][]byte, nkeys)
+	for i := range keys {
+		keys[i] = node.getKey(uint16(i))
+		if len(keys[i]) > maxKeySize(v.db.PageSize) {
+			v.failPage(ptr, "key %d is too large", i)
+			return
+		}
+	}
+	if !bytes.Equal(keys[0], first) {
+		v.failPage(ptr, "the first key %q doesn't match the parent key %q", keys[0], first)
+	}
+	for i := 1; i < len(keys); i++ {
+		if bytes.Compare(keys[i-1], keys[i]) >= 0 {
+			v.failPage(ptr, "key %d is not sorted", i)
+			return
+		}
+	}
+	if stop != nil && bytes.Compare(keys[nkeys-1], stop) >= 0 {
+		v.failPage(ptr, "the keys are out of the parent range")
+	}
+
+	for i := uint16(0); i < nkeys; i++ {
+		if node.btype() == BNODE_LEAF {
+			if node.isOverflow(i) {
+				v.overflow(ptr, node.getVal(i))
+			}
+			continue
+		}
+		kidStop := stop
+		if i+1 < nkeys {
+			kidStop = keys[i+1]
+		}
+		v.tree(node.getPtr(i), keys[i], kidStop, depth+1)
+	}
+}
+
+// check the layout of a node before reading the keys
+func nodeCheck(node BNode, pageSize int) error {
+	size := nodeSize(pageSize)
+	btype, nkeys := node.btype(), int(node.nkeys())
+	if btype != BNODE_LEAF && btype != BNODE_NODE {
+		return fmt.Errorf("%w: bad node type %d", ErrCorrupted, btype)
+	}
+	if nkeys == 0 {
+		return fmt.Errorf("%w: empty node", ErrCorrupted)
+	}
+	// the prefix is not read before the bounds are checked
+	plen := int(binary.LittleEndian.Uint16(node.data[HEADER:]))
+	kvs := HEADER + 2 + plen + 10*nkeys // the KVs start after the pointers and the offsets
+	if kvs > size {
+		return fmt.Errorf("%w: too many keys", ErrCorrupted)
+	}
+	if btype == BNODE_NODE && plen > 0 {
+		return fmt.Errorf("%w: an internal node with a prefix", ErrCorrupted)
+	}
+	for i := uint16(0); i < uint16(nkeys); i++ {
+		pos := kvs + int(node.getOffset(i))
+		if pos+4 > size {
+			return fmt.Errorf("%w: bad offset of key %d", ErrCorrupted, i)
+		}
+		klen := int(binary.LittleEndian.Uint16(node.data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.data[pos+2:]) &^ BNODE_VAL_OVERFLOW)
+		if int(node.getOffset(i+1)) != int(node.getOffset(i))+4+klen+vlen || pos+4+klen+vlen > size {
+			return fmt.Errorf("%w: bad offset of key %d", ErrCorrupted, i)
+		}
+		if btype == BNODE_NODE && vlen != 0 {
+			return fmt.Errorf("%w: a value in an internal node", ErrCorrupted)
+		}
+	}
+	return nil
+}
+
+// check the overflow chain of a value in the leaf
+func (v *verifier) overflow(leaf uint64, stub []byte) {
+	if len(stub) != OVERFLOW_STUB {
+		v.failPage(leaf, "bad overflow stub")
+		return
+	}
+	total := binary.LittleEndian.Uint64(stub[0:])
+	size := uint64(0)
+	for ptr := binary.LittleEndian.Uint64(stub[8:]); ptr != 0; {
+		if !v.use(ptr, PAGE_OVERFLOW) {
+			return
+		}
+		node, err := v.page(ptr)
+		if err != nil {
+			v.fail(err)
+			return
+		}
+		if node.btype() != BNODE_OVERFLOW || overflowSize(node) > overflowCap(v.db.PageSize) {
+			v.failPage(ptr, "bad overflow page")
+			return
+		}
+		size += uint64(overflowSize(node))
+		ptr = binary.LittleEndian.Uint64(node.data[4:])
+	}
+	if size != total {
+		v.failPage(leaf, "the overflow chain has %d bytes instead of %d", size, total)
+	}
+}
+
+// check the free list and mark the free pages
+func (v *verifier) freeList() {
+	db := v.db
+	if db.free.head == 0 {
+		return
+	}
+	// the first `nfree` pointers are taken while the free list
+	// is kept as is, see KV.deferred.
+	taken, count := 0, uint64(0)
+	total := uint64(0)
+	for ptr := db.free.head; ptr != 0; {
+		if !v.use(ptr, PAGE_FREE_LIST) {
+			return
+		}
+		node, err := v.page(ptr)
+		if err != nil {
+			v.fail(err)
+			return
+		}
+		// the node of a new file is all zeros
+		empty := node.btype() == 0 && flnSize(node) == 0 && flnNext(node) == 0
+		if (node.btype() != BNODE_FREE_LIST && !empty) || flnSize(node) > db.free.cap() {
+			v.failPage(ptr, "bad free list node")
+			return
+		}
+		if ptr == db.free.head {
+			total = binary.LittleEndian.Uint64(node.data[4:])
+		}
+		for i := flnSize(node) - 1; i >= 0; i-- {
+			if taken < db.page.nfree {
+				taken++
+			} else {
+				v.use(flnPtr(node, i), PAGE_FREE)
+			}
+		}
+		count += uint64(flnSize(node))
+		ptr = flnNext(node)
+	}
+	if count != total {
+		v.failPage(db.free.head, "the free list has %d pointers instead of %d", count, total)
+	}
+}
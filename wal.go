@@ -0,0 +1,247 @@
+package tinydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	WAL_SIG             = "TINYWAL1"
+	WAL_HEADER          = 8 + 8 // sig(8B) + seq(8B)
+	WAL_RECORD_HEADER   = 4 + 4 // size(4B) + crc32(4B)
+	WAL_CHECKPOINT_SIZE = 4 << 20
+)
+
+// the write-ahead log of the WAL mode.
+// a commit appends its updates to the log instead of writing the master
+// page, the pages of the B-tree are written to the mmap without syncing.
+// a checkpoint makes the B-tree durable, updates the master page, and
+// resets the log. Open replays the log on the last checkpoint.
+// the log format:
+// | sig | seq | records |
+// | 8B  | 8B  | ...     |
+// the seq is of the master page of the checkpoint, the log is discarded
+// if it doesn't match, which means the log reset was interrupted.
+// the record of a commit:
+// | size | crc32 | updates    |
+// | 4B   | 4B    | size * 1B  |
+// the update format:
+// | flag | klen | vlen | key | val |
+// | 1B   | 2B   | 4B   | ... | ... |
+// a torn record at the end is discarded.
+
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// open the log and replay the commits since the last checkpoint.
+// it's removed after the replay if the WAL mode is not used.
+// the writer locks the log until it's closed or removed, a read-only
+// open skips the log while it's locked, thus it sees the last checkpoint.
+func walOpen(db *KV, fresh bool) error {
+	flag := os.O_RDWR
+	if db.ReadOnly {
+		flag = os.O_RDONLY
+	} else if db.WAL {
+		flag |= os.O_CREATE
+	}
+	fp, err := os.OpenFile(walPath(db.Path), flag, db.FileMode)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if db.ReadOnly {
+		defer fp.Close()
+		return walCheck(db, fp, fresh)
+	}
+	// the read-only opens only probe the lock, it's not contended
+	if err := fileLockWait(fp, syscall.LOCK_EX); err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("lock log: %w", err)
+	}
+
+	var records [][]byte
+	if !fresh { // an old log of a removed file
+		records, err = walRead(db, fp)
+	}
+	if err != nil {
+		_ = fp.Close()
+		return err
+	}
+
+	db.wal.fp = fp
+	for _, rec := range records {
+		if err := walApply(db, rec); err != nil {
+			return err
+		}
+	}
+	db.root = db.tree.root
+	if db.WAL {
+		// the pages freed by the replay go to the free list
+		return flushPages(db)
+	}
+	db.wal.fp = nil
+	defer fp.Close() // unlocked after the removal
+	if err := flushPages(db); err != nil {
+		return err
+	}
+	return os.Remove(walPath(db.Path))
+}
+
+// a read-only open can't replay the log, it fails if the log has
+// the commits of a writer that is not running.
+func walCheck(db *KV, fp *os.File, fresh bool) error {
+	err := syscall.Flock(int(fp.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return nil // locked by the writer
+	}
+	if err != nil {
+		return err
+	}
+	// the writer can remove it before the lock is taken
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	if cur, err := os.Stat(walPath(db.Path)); err != nil || !os.SameFile(fi, cur) {
+		return nil
+	}
+
+	if fresh {
+		return nil // an old log of a removed file
+	}
+	records, err := walRead(db, fp)
+	if err == nil && len(records) > 0 {
+		err = errors.New("the log must be replayed by a writer")
+	}
+	return err
+}
+
+// read the records of the log
+func walRead(db *KV, fp *os.File) ([][]byte, error) {
+	data, err := io.ReadAll(io.NewSectionReader(fp, 0, 1<<62))
+	if err != nil {
+		return nil, fmt.Errorf("read log: %w", err)
+	}
+	if len(data) < WAL_HEADER || !bytes.Equal(data[:8], []byte(WAL_SIG)) {
+		return nil, nil
+	}
+	if binary.LittleEndian.Uint64(data[8:]) != db.master.seq {
+		return nil, nil
+	}
+
+	var records [][]byte
+	for data = data[WAL_HEADER:]; len(data) > 0; {
+		size := 0
+		if len(data) >= WAL_RECORD_HEADER {
+			size = int(binary.LittleEndian.Uint32(data[0:]))
+		}
+		if len(data) < WAL_RECORD_HEADER || len(data)-WAL_RECORD_HEADER < size {
+			db.Logger.Printf("tinydb: %s: a torn log record is discarded", db.Path)
+			break
+		}
+		rec := data[WAL_RECORD_HEADER:][:size]
+		if crc32.ChecksumIEEE(rec) != binary.LittleEndian.Uint32(data[4:]) {
+			db.Logger.Printf("tinydb: %s: a torn log record is discarded", db.Path)
+			break
+		}
+		records = append(records, rec)
+		data = data[WAL_RECORD_HEADER+size:]
+	}
+	return records, nil
+}
+
+// apply the updates of a record to the B-tree
+func walApply(db *KV, rec []byte) (err error) {
+	defer recoverPageError(&err)
+	for len(rec) > 0 {
+		if len(rec) < 7 {
+			return fmt.Errorf("%w: bad log record", ErrCorrupted)
+		}
+		flag := rec[0]
+		klen := int(binary.LittleEndian.Uint16(rec[1:]))
+		vlen := int(binary.LittleEndian.Uint32(rec[3:]))
+		if len(rec)-7 < klen+vlen {
+			return fmt.Errorf("%w: bad log record", ErrCorrupted)
+		}
+		key, val := rec[7:][:klen], rec[7+klen:][:vlen]
+		switch flag {
+		case FLAG_UPDATED:
+			err = db.tree.Insert(key, val)
+		case FLAG_DELETED:
+			_, err = db.tree.Delete(key)
+		default:
+			err = fmt.Errorf("%w: bad log record", ErrCorrupted)
+		}
+		if err != nil {
+			return err
+		}
+		rec = rec[7+klen+vlen:]
+	}
+	return nil
+}
+
+// log the updates of a commit, the writer lock is held
+func walCommit(db *KV, tx *KVTX) error {
+	rec := make([]byte, WAL_RECORD_HEADER)
+	for iter := tx.pending.Seek(nil); iter.Valid(); iter.Next() {
+		key, val := iter.Key(), iter.Val()
+		if val[0] == FLAG_BLOB {
+			// the blob pages are durable only when the master page
+			// points to them, they can't be replayed.
+			return checkpoint(db)
+		}
+		rec = append(rec, val[0])
+		rec = binary.LittleEndian.AppendUint16(rec, uint16(len(key)))
+		rec = binary.LittleEndian.AppendUint32(rec, uint32(len(val)-1))
+		rec = append(rec, key...)
+		rec = append(rec, val[1:]...)
+	}
+	binary.LittleEndian.PutUint32(rec[0:], uint32(len(rec)-WAL_RECORD_HEADER))
+	binary.LittleEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[WAL_RECORD_HEADER:]))
+
+	if _, err := db.wal.fp.WriteAt(rec, db.wal.size); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	if db.wal.size+int64(len(rec)) >= int64(db.CheckpointSize) {
+		return checkpoint(db)
+	}
+	if db.Sync == SYNC_FULL {
+		// the record is overwritten by the next one if this fails
+		if err := walSync(db); err != nil {
+			return err
+		}
+	}
+	db.wal.size += int64(len(rec))
+	return nil
+}
+
+func walSync(db *KV) error {
+	if err := db.wal.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync log: %w", err)
+	}
+	return nil
+}
+
+// empty the log after a checkpoint
+func walReset(db *KV) error {
+	if err := db.wal.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	var header [WAL_HEADER]byte
+	copy(header[:8], WAL_SIG)
+	binary.LittleEndian.PutUint64(header[8:], db.master.seq)
+	if _, err := db.wal.fp.WriteAt(header[:], 0); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	db.wal.size = WAL_HEADER
+	return walSync(db)
+}